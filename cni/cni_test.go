@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -9,22 +10,27 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/markstgodard/go-keystone/keystone"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gbytes"
 	"github.com/onsi/gomega/gexec"
 )
 
 var _ = Describe("Neutron CNI Plugin", func() {
 
 	var (
-		neutronServer  *httptest.Server
+		neutron        *fakeNeutron
 		keystoneServer *httptest.Server
 		stateDir       string
 		cmd            *exec.Cmd
 		input          string
-		networkID      string
+
+		keystoneRequests int32
+		keystoneIdentity []byte
+		keystoneScope    []byte
 	)
 
 	const delegateInput = `
@@ -43,6 +49,7 @@ var _ = Describe("Neutron CNI Plugin", func() {
   "keystone_username": "admin",
   "keystone_password": "secret",
   "state_dir": "%s",
+  "host_id": "some-host",
   "metadata": {
     "app_id": "d5bbc5ed-886a-44e6-945d-67df1013fa16",
     "org_id": "2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
@@ -53,41 +60,59 @@ var _ = Describe("Neutron CNI Plugin", func() {
 		delegateInput +
 		`}`
 
-	const getNetworksByNameResp = `{
-    "networks": []
-}`
-	const createPortResp = `{
-    "port": {
-        "admin_state_up": true,
-        "device_id": "d6b4d3a5-c700-476f-b609-1493dd9dadc0",
-        "device_owner": "",
-        "fixed_ips": [
-            {
-                "ip_address": "1.2.3.4",
-                "subnet_id": "22b44fc2-4ffb-4de4-b0f9-69d58b37ae27"
-            }
-        ],
-        "id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
-        "mac_address": "fa:16:3e:a6:50:c1",
-        "name": "some-container-id",
-        "network_id": "6aeaf34a-c482-4bd3-9dc3-7faf36412f12",
-        "status": "ACTIVE",
-        "tenant_id": "cf1a5775e766426cb1968766d0191908"
-    }
+	const addResult = `{
+  "cniVersion": "0.2.0",
+  "ip4": {
+    "ip": "1.2.3.4/32",
+    "gateway": "10.0.3.1",
+    "routes": [ { "dst": "10.0.3.0/24" }, { "dst": "0.0.0.0/0", "gw": "10.0.3.1" } ]
+  },
+  "dns": {}
 }`
 
-	const createNetworkResp = `{
-  "network": {
-    "id": "cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6"
-  }
-}
-`
-	const createSubnetResp = `{
-  "subnet": {
-    "id": "cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6"
-  }
-}
-`
+	// validCredentials checks the identity of a keystone auth request
+	// against the credentials known to the fake keystone server
+	var validCredentials = func(identity []byte) bool {
+		var id struct {
+			Methods  []string `json:"methods"`
+			Password *struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+			ApplicationCredential *struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			} `json:"application_credential"`
+		}
+		if err := json.Unmarshal(identity, &id); err != nil || len(id.Methods) != 1 {
+			return false
+		}
+
+		switch id.Methods[0] {
+		case "password":
+			return id.Password != nil &&
+				id.Password.User.Name == "admin" &&
+				id.Password.User.Password == "secret"
+		case "application_credential":
+			return id.ApplicationCredential != nil &&
+				id.ApplicationCredential.ID == "some-app-cred-id" &&
+				id.ApplicationCredential.Secret == "some-app-cred-secret"
+		}
+		return false
+	}
+
+	var withConfig = func(input string, extra map[string]interface{}) string {
+		conf := map[string]interface{}{}
+		Expect(json.Unmarshal([]byte(input), &conf)).To(Succeed())
+		for k, v := range extra {
+			conf[k] = v
+		}
+		data, err := json.Marshal(conf)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data)
+	}
 
 	var cniCommand = func(command, input string) *exec.Cmd {
 		toReturn := exec.Command(paths.PathToPlugin)
@@ -105,46 +130,62 @@ var _ = Describe("Neutron CNI Plugin", func() {
 
 	BeforeEach(func() {
 		var err error
-		// setup fake neutron server
-		neutronServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			switch r.Method {
-			case http.MethodGet:
-				w.WriteHeader(http.StatusOK)
-				w.Write([]byte(getNetworksByNameResp))
-			case http.MethodPost:
-				w.WriteHeader(http.StatusCreated)
-				var resp string
-				if strings.Contains(r.RequestURI, "ports") {
-					resp = createPortResp
-				} else if strings.Contains(r.RequestURI, "networks") {
-					resp = createNetworkResp
-				} else {
-					resp = createSubnetResp
-				}
-				w.Write([]byte(resp))
-
-			case http.MethodDelete:
-				w.WriteHeader(http.StatusNoContent)
-			}
-		}))
+		neutron = newFakeNeutron()
 
-		// setup fake keystone server
+		// setup fake keystone server, issuing a new token for every request
+		keystoneRequests = 0
 		keystoneServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.Header().Set(keystone.X_SUBJECT_TOKEN_HEADER, "fake-token")
+			var req struct {
+				Auth struct {
+					Identity json.RawMessage `json:"identity"`
+					Scope    json.RawMessage `json:"scope"`
+				} `json:"auth"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/v3/auth/tokens" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			keystoneIdentity = req.Auth.Identity
+			keystoneScope = req.Auth.Scope
+
+			// a misbehaving keystone that echoes the request back
+			if strings.Contains(string(req.Auth.Identity), "echo-me") {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write(req.Auth.Identity)
+				return
+			}
+
+			if !validCredentials(req.Auth.Identity) ||
+				strings.Contains(string(req.Auth.Scope), "rejected-project") ||
+				strings.Contains(string(req.Auth.Scope), "rejected-trust") {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(unauthorizedResp))
+				return
+			}
+
+			n := atomic.AddInt32(&keystoneRequests, 1)
+			w.Header().Set("X-Subject-Token", fmt.Sprintf("fake-token-%d", n))
 			w.WriteHeader(http.StatusCreated)
+			if len(req.Auth.Scope) > 0 {
+				w.Write([]byte(`{
+  "token": {
+    "expires_at": "2999-01-01T00:00:00.000000Z",
+    "project": { "id": "some-project-id", "name": "cf" }
+  }
+}`))
+			}
 		}))
 
 		stateDir, err = ioutil.TempDir("", "cniStateDir")
 		Expect(err).ToNot(HaveOccurred())
 
-		networkID = "6aeaf34a-c482-4bd3-9dc3-7faf36412f12"
-		input = fmt.Sprintf(inputTemplate, neutronServer.URL, keystoneServer.URL, stateDir)
+		input = fmt.Sprintf(inputTemplate, neutron.URL, keystoneServer.URL, stateDir)
 	})
 
 	AfterEach(func() {
-		neutronServer.Close()
+		neutron.Close()
 		keystoneServer.Close()
-		os.Remove(stateDir)
+		os.RemoveAll(stateDir)
 	})
 
 	Context("ADD and DEL", func() {
@@ -154,7 +195,7 @@ var _ = Describe("Neutron CNI Plugin", func() {
 			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
 			Expect(err).NotTo(HaveOccurred())
 			Eventually(session).Should(gexec.Exit(0))
-			Expect(session.Out.Contents()).To(MatchJSON(`{ "ip4": { "ip": "1.2.3.4/32" }, "dns":{} }`))
+			Expect(session.Out.Contents()).To(MatchJSON(addResult))
 
 			By("checking container state info stored")
 			path := filepath.Join(stateDir, "some-container-id")
@@ -165,7 +206,8 @@ var _ = Describe("Neutron CNI Plugin", func() {
 			Expect(err).NotTo(HaveOccurred())
 			Expect(data).To(MatchJSON(`{
   "ip": "1.2.3.4/32",
-   "neutron_port_id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"
+   "neutron_port_id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
+   "network_id": "cc6c1929-6b26-4a1a-8680-000000000001"
 }`))
 
 			By("calling DEL")
@@ -179,4 +221,1723 @@ var _ = Describe("Neutron CNI Plugin", func() {
 			Expect(os.IsNotExist(err)).To(BeTrue())
 		})
 	})
+
+	Context("DEL retried for the same container", func() {
+		It("succeeds again once the container is gone", func() {
+			for _, command := range []string{"ADD", "DEL", "DEL"} {
+				cmd = cniCommand(command, input)
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+			}
+
+			Expect(neutron.ports.deleted).To(ConsistOf("ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"))
+		})
+
+		It("removes the container state when an earlier DEL already deleted the port", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			neutron.ports.deleted = []string{"ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"}
+
+			cmd = cniCommand("DEL", input)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			_, err = os.Stat(filepath.Join(stateDir, "some-container-id"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Context("ADD retried for the same container", func() {
+		It("reuses the existing neutron port", func() {
+			By("calling ADD")
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(addResult))
+
+			By("calling ADD again")
+			cmd = cniCommand("ADD", input)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(addResult))
+
+			By("checking only one port was created")
+			Expect(atomic.LoadInt32(&neutron.ports.created)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.ports.live)).To(BeEquivalentTo(1))
+		})
+
+		It("reuses a port left behind without container state", func() {
+			By("calling ADD")
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("losing the container state")
+			Expect(os.Remove(filepath.Join(stateDir, "some-container-id"))).To(Succeed())
+
+			By("calling ADD again")
+			cmd = cniCommand("ADD", input)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(addResult))
+
+			Expect(atomic.LoadInt32(&neutron.ports.created)).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("network creation", func() {
+		It("creates a single network for concurrent ADDs in a new space", func() {
+			var sessions []*gexec.Session
+			for i := 0; i < 5; i++ {
+				cmd = cniCommand("ADD", input)
+				cmd.Env = append(cmd.Env, fmt.Sprintf("CNI_CONTAINERID=container-%d", i))
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				sessions = append(sessions, session)
+			}
+			for _, session := range sessions {
+				Eventually(session).Should(gexec.Exit(0))
+			}
+
+			Expect(atomic.LoadInt32(&neutron.networks.created)).To(BeEquivalentTo(1))
+		})
+
+		It("converges on a single network when another host races to create it", func() {
+			neutron.networks.racingID = "00000000-0000-0000-0000-000000000001"
+			neutron.networks.racingCreatedAt = "2026-10-17T12:00:00Z"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("deleting its own duplicate network and subnet")
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+			Expect(neutron.networks.ids).To(ConsistOf(neutron.networks.racingID))
+
+			By("creating the port on the winning network")
+			Expect(neutron.ports.networkID).To(Equal(neutron.networks.racingID))
+		})
+
+		It("keeps its network when the racing network was created later", func() {
+			neutron.networks.racingID = "00000000-0000-0000-0000-000000000001"
+			neutron.networks.racingCreatedAt = "2026-10-17T12:00:02Z"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("leaving the newer network to the host that created it")
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(0))
+			Expect(neutron.ports.networkID).To(Equal("cc6c1929-6b26-4a1a-8680-000000000001"))
+		})
+
+		It("breaks ties between networks created in the same second by ID", func() {
+			neutron.networks.racingID = "00000000-0000-0000-0000-000000000001"
+			neutron.networks.racingCreatedAt = "2026-10-17T12:00:01Z"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+			Expect(neutron.ports.networkID).To(Equal(neutron.networks.racingID))
+		})
+
+		It("creates the network again when it is deleted before the port is created", func() {
+			neutron.networks.ids = []string{"deleted-network"}
+			neutron.networks.deletedBeforePort = true
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&neutron.networks.created)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.ports.created)).To(BeEquivalentTo(1))
+			Expect(neutron.ports.networkID).To(Equal("cc6c1929-6b26-4a1a-8680-000000000001"))
+		})
+
+		It("restores the subnets and router interfaces of a network another host emptied", func() {
+			input = withConfig(input, map[string]interface{}{
+				"manage_routers": true,
+				"ipv6_mode":      "slaac",
+				"ipv6_supernet":  "fd00:64::/48",
+			})
+			neutron.ports.dualStack = true
+			neutron.networks.ids = []string{"emptied-network"}
+			neutron.subnets.created = []map[string]interface{}{
+				{"id": "some-subnet", "network_id": "emptied-network", "ip_version": 4, "cidr": "10.0.3.0/24"},
+			}
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&neutron.networks.created)).To(BeZero())
+			Expect(neutron.subnets.requests).To(HaveLen(1))
+			Expect(neutron.subnets.requests[0]).To(ContainSubstring(`"ip_version":6`))
+			Expect(neutron.routers.interfaces).To(Equal(map[string]string{
+				"some-subnet":                          "router-1",
+				"83a8b5d3-1a6f-4e0e-9e27-4a1a0a4b7c6e": "router-1",
+			}))
+			Expect(neutron.ports.networkID).To(Equal("emptied-network"))
+		})
+	})
+
+	Context("subnet allocation", func() {
+		It("uses the default subnet when none is configured", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.subnets.requests).To(HaveLen(1))
+			Expect(neutron.subnets.requests[0]).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "ip_version": 4,
+  "cidr": "10.0.3.0/24",
+  "allocation_pools": [ { "start": "10.0.3.20", "end": "10.0.3.150" } ],
+  "tags": ["gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"]
+}`))
+		})
+
+		It("carves a free subnet out of the supernet", func() {
+			neutron.subnets.existing = []string{"10.64.0.0/24", "192.168.0.0/16", "10.64.2.0/23"}
+			input = withConfig(input, map[string]interface{}{
+				"supernet":          "10.64.0.0/20",
+				"subnet_prefix_len": 24,
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.subnets.requests).To(HaveLen(1))
+			Expect(neutron.subnets.requests[0]).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "ip_version": 4,
+  "cidr": "10.64.1.0/24",
+  "tags": ["gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"]
+}`))
+		})
+
+		It("skips past large used subnets of an IPv6 supernet", func() {
+			neutron.subnets.existing = []string{"10.0.3.0/24", "fd00::/33"}
+			neutron.ports.dualStack = true
+			input = withConfig(input, map[string]interface{}{
+				"ipv6_mode":     "slaac",
+				"ipv6_supernet": "fd00::/32",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.subnets.requests).To(HaveLen(2))
+			Expect(neutron.subnets.requests[1]).To(ContainSubstring(`"ip_version":6`))
+			Expect(neutron.subnets.requests[1]).To(ContainSubstring(`"cidr":"fd00:0:8000::/64"`))
+		})
+
+		It("picks another subnet when another host took the same one first", func() {
+			neutron.subnets.racing = true
+			input = withConfig(input, map[string]interface{}{
+				"supernet":          "10.64.0.0/20",
+				"subnet_prefix_len": 24,
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.subnets.requests).To(HaveLen(2))
+			Expect(neutron.subnets.requests[0]).To(ContainSubstring(`"cidr":"10.64.0.0/24"`))
+			Expect(neutron.subnets.requests[1]).To(ContainSubstring(`"cidr":"10.64.1.0/24"`))
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(0))
+		})
+
+		It("fails clearly when the supernet is exhausted", func() {
+			neutron.subnets.existing = []string{"10.64.0.0/23"}
+			input = withConfig(input, map[string]interface{}{
+				"supernet":          "10.64.0.0/23",
+				"subnet_prefix_len": 24,
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`supernet 10.64.0.0/23 has no free /24 subnets left`))
+
+			By("removing the network it created")
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("allocates the subnet from a neutron subnet pool", func() {
+			input = withConfig(input, map[string]interface{}{
+				"subnetpool_id":     "some-subnetpool-id",
+				"subnet_prefix_len": 26,
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.subnets.requests).To(HaveLen(1))
+			Expect(neutron.subnets.requests[0]).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "ip_version": 4,
+  "subnetpool_id": "some-subnetpool-id",
+  "prefixlen": 26,
+  "tags": ["gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"]
+}`))
+		})
+	})
+
+	Context("subnet routes", func() {
+		It("passes the subnet host routes and DNS servers to the delegate", func() {
+			neutron.subnets.hostRoutes = `[ { "destination": "10.10.0.0/16", "nexthop": "10.0.3.254" } ]`
+			neutron.subnets.dns = `[ "10.0.3.2", "8.8.8.8" ]`
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(`{
+  "cniVersion": "0.2.0",
+  "ip4": {
+    "ip": "1.2.3.4/32",
+    "gateway": "10.0.3.1",
+    "routes": [
+      { "dst": "10.0.3.0/24" },
+      { "dst": "0.0.0.0/0", "gw": "10.0.3.1" },
+      { "dst": "10.10.0.0/16", "gw": "10.0.3.254" }
+    ]
+  },
+  "dns": { "nameservers": [ "10.0.3.2", "8.8.8.8" ] }
+}`))
+		})
+	})
+
+	Context("network segments", func() {
+		var delegateConfig string
+
+		BeforeEach(func() {
+			delegateConfig = filepath.Join(stateDir, "delegate-config")
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":          "noop",
+					"record_config": delegateConfig,
+				},
+			})
+		})
+
+		It("passes the network type and segmentation ID to the delegate", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			data, err := ioutil.ReadFile(delegateConfig)
+			Expect(err).NotTo(HaveOccurred())
+			var config map[string]interface{}
+			Expect(json.Unmarshal(data, &config)).To(Succeed())
+			Expect(config).To(HaveKeyWithValue("network_type", "vxlan"))
+			Expect(config).To(HaveKeyWithValue("segmentation_id", BeEquivalentTo(1001)))
+		})
+
+		It("passes the Neutron port ID and MAC address to the delegate", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			data, err := ioutil.ReadFile(delegateConfig)
+			Expect(err).NotTo(HaveOccurred())
+			var config map[string]interface{}
+			Expect(json.Unmarshal(data, &config)).To(Succeed())
+			Expect(config).To(HaveKeyWithValue("port_id", "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"))
+			Expect(config).To(HaveKeyWithValue("mac_address", "fa:16:3e:a6:50:c1"))
+		})
+
+		It("binds the port to this host and skips the segment lookup for the Neutron OVS agent", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":          "noop",
+					"mode":          "neutron_agent",
+					"record_config": delegateConfig,
+				},
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&neutron.networks.lookups)).To(BeZero())
+			Expect(neutron.ports.request).To(ContainSubstring(`"binding:host_id":"some-host"`))
+			Expect(neutron.ports.request).To(ContainSubstring(`"device_owner":"compute:gofer"`))
+
+			data, err := ioutil.ReadFile(delegateConfig)
+			Expect(err).NotTo(HaveOccurred())
+			var config map[string]interface{}
+			Expect(json.Unmarshal(data, &config)).To(Succeed())
+			Expect(config).NotTo(HaveKey("segmentation_id"))
+			Expect(config).To(HaveKeyWithValue("port_id", "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"))
+		})
+
+		It("does not bind the port for other delegates", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.request).NotTo(ContainSubstring(`binding:host_id`))
+			Expect(neutron.ports.request).To(ContainSubstring(`"device_owner":"gofer:container"`))
+		})
+
+		It("leaves the segment out when the segmentation ID is not visible", func() {
+			neutron.networks.segmentationID = "null"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			data, err := ioutil.ReadFile(delegateConfig)
+			Expect(err).NotTo(HaveOccurred())
+			var config map[string]interface{}
+			Expect(json.Unmarshal(data, &config)).To(Succeed())
+			Expect(config).NotTo(HaveKey("network_type"))
+			Expect(config).NotTo(HaveKey("segmentation_id"))
+		})
+	})
+
+	Context("policy group security groups", func() {
+		It("creates a security group for the policy group and attaches it to the port", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.securityGroups.ids).To(ConsistOf("secgroup-1"))
+			Expect(neutron.securityGroups.ruleRequests).To(HaveLen(2))
+			Expect(neutron.securityGroups.ruleRequests[0]).To(MatchJSON(`{
+  "security_group_id": "secgroup-1",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "remote_group_id": "secgroup-1"
+}`))
+			Expect(neutron.securityGroups.ruleRequests[1]).To(MatchJSON(`{
+  "security_group_id": "secgroup-1",
+  "direction": "ingress",
+  "ethertype": "IPv6",
+  "remote_group_id": "secgroup-1"
+}`))
+			Expect(neutron.ports.request).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "name": "some-container-id",
+  "admin_state_up": true,
+  "security_groups": ["secgroup-1"],
+  "device_owner": "gofer:container",
+  "device_id": "some-container-id",
+  "tags": [
+    "gofer",
+    "app_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
+    "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8",
+    "policy_group_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "host:some-host"
+  ]
+}`))
+		})
+
+		It("reuses the security group of a policy group that already has one", func() {
+			neutron.securityGroups.ids = []string{"secgroup-0"}
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.securityGroups.ids).To(ConsistOf("secgroup-0"))
+			Expect(neutron.securityGroups.ruleRequests).To(BeEmpty())
+			Expect(neutron.ports.request).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "name": "some-container-id",
+  "admin_state_up": true,
+  "security_groups": ["secgroup-0"],
+  "device_owner": "gofer:container",
+  "device_id": "some-container-id",
+  "tags": [
+    "gofer",
+    "app_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
+    "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8",
+    "policy_group_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "host:some-host"
+  ]
+}`))
+		})
+
+		It("locks policy group ports down to their group, leaving out the project default group", func() {
+			neutron.securityGroups.ids = []string{"default-secgroup"}
+			neutron.securityGroups.names["default-secgroup"] = "default"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.request).To(ContainSubstring(`"security_groups":["secgroup-2"]`))
+			Expect(neutron.ports.request).NotTo(ContainSubstring(`default-secgroup`))
+		})
+
+		It("leaves ports without a policy group to the project default group", func() {
+			conf := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(input), &conf)).To(Succeed())
+			delete(conf["metadata"].(map[string]interface{}), "policy_group_id")
+			data, err := json.Marshal(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			cmd = cniCommand("ADD", string(data))
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.securityGroups.ids).To(BeEmpty())
+			Expect(neutron.ports.request).NotTo(ContainSubstring(`security_groups`))
+		})
+
+		It("deletes the security group it created on rollback", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":     "noop",
+					"fail_add": true,
+				},
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(neutron.securityGroups.ids).To(BeEmpty())
+			Expect(atomic.LoadInt32(&neutron.securityGroups.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("disables port security instead when configured to", func() {
+			input = withConfig(input, map[string]interface{}{
+				"disable_port_security": true,
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.securityGroups.ids).To(BeEmpty())
+			Expect(neutron.ports.request).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "name": "some-container-id",
+  "admin_state_up": true,
+  "port_security_enabled": false,
+  "device_owner": "gofer:container",
+  "device_id": "some-container-id",
+  "tags": [
+    "gofer",
+    "app_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
+    "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8",
+    "policy_group_id:d5bbc5ed-886a-44e6-945d-67df1013fa16",
+    "host:some-host"
+  ]
+}`))
+		})
+	})
+
+	Context("resource tags", func() {
+		It("tags the network with the cluster and space and only looks up tagged networks", func() {
+			input = withConfig(input, map[string]interface{}{
+				"cluster_id": "cf-prod",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.networks.request).To(MatchJSON(`{
+  "name": "4246c57d-aefc-49cc-afe0-5f734e2656e8",
+  "description": "4246c57d-aefc-49cc-afe0-5f734e2656e8",
+  "admin_state_up": true,
+  "tags": [
+    "gofer",
+    "cluster_id:cf-prod",
+    "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
+    "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"
+  ]
+}`))
+			Expect(neutron.networks.tags).To(Equal("gofer,cluster_id:cf-prod"))
+			Expect(neutron.ports.request).To(ContainSubstring(`"cluster_id:cf-prod"`))
+			Expect(neutron.subnets.requests[0]).To(ContainSubstring(`"cluster_id:cf-prod"`))
+		})
+
+		It("adopts the untagged network, router and security group of an earlier release", func() {
+			input = withConfig(input, map[string]interface{}{
+				"manage_routers": true,
+			})
+			neutron.networks.ids = []string{"old-network"}
+			neutron.networks.legacy.ids = []string{"old-network"}
+			neutron.routers.ids = []string{"old-router"}
+			neutron.routers.legacy.ids = []string{"old-router"}
+			neutron.securityGroups.ids = []string{"old-secgroup"}
+			neutron.securityGroups.legacy.ids = []string{"old-secgroup"}
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&neutron.networks.created)).To(BeZero())
+			Expect(neutron.networks.legacy.tags).To(Equal(map[string][]string{
+				"old-network": {"gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"},
+			}))
+			Expect(neutron.ports.networkID).To(Equal("old-network"))
+
+			Expect(neutron.routers.ids).To(ConsistOf("old-router"))
+			Expect(neutron.routers.legacy.tags).To(Equal(map[string][]string{
+				"old-router": {"gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4"},
+			}))
+
+			Expect(neutron.securityGroups.ids).To(ConsistOf("old-secgroup"))
+			Expect(neutron.securityGroups.legacy.tags).To(Equal(map[string][]string{
+				"old-secgroup": {"gofer"},
+			}))
+			Expect(neutron.ports.request).To(ContainSubstring(`"security_groups":["old-secgroup"]`))
+		})
+
+		It("rejects a cluster id that can not be used in a tag filter", func() {
+			input = withConfig(input, map[string]interface{}{
+				"cluster_id": "cf,prod",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`invalid 'cluster_id'`))
+		})
+	})
+
+	Context("CNI 1.0.0", func() {
+		const result = `{
+  "cniVersion": "1.0.0",
+  "interfaces": [ { "name": "some-eth0", "sandbox": "/some/netns/path" } ],
+  "ips": [ { "interface": 0, "address": "1.2.3.4/32", "gateway": "10.0.3.1" } ],
+  "routes": [ { "dst": "10.0.3.0/24" }, { "dst": "0.0.0.0/0", "gw": "10.0.3.1" } ],
+  "dns": {}
+}`
+
+		var checkInput string
+
+		BeforeEach(func() {
+			input = withConfig(input, map[string]interface{}{
+				"cniVersion": "1.0.0",
+			})
+
+			var prevResult map[string]interface{}
+			Expect(json.Unmarshal([]byte(result), &prevResult)).To(Succeed())
+			checkInput = withConfig(input, map[string]interface{}{
+				"prevResult": prevResult,
+			})
+		})
+
+		add := func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(result))
+		}
+
+		It("returns the interfaces and addresses of the delegate", func() {
+			add()
+		})
+
+		It("checks the neutron port and delegates CHECK", func() {
+			add()
+
+			cmd = cniCommand("CHECK", checkInput)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+		})
+
+		It("fails CHECK when the neutron port is not active", func() {
+			add()
+			neutron.ports.status = "DOWN"
+
+			cmd = cniCommand("CHECK", checkInput)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`neutron port ebe69f1e-bc26-4db5-bed0-c0afb4afe3db is DOWN, expected ACTIVE`))
+		})
+
+		It("fails CHECK when the address is missing from prevResult", func() {
+			add()
+
+			checkInput = withConfig(checkInput, map[string]interface{}{
+				"prevResult": map[string]interface{}{
+					"cniVersion": "1.0.0",
+					"ips":        []map[string]interface{}{{"address": "1.2.3.5/32"}},
+				},
+			})
+			cmd = cniCommand("CHECK", checkInput)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`address 1.2.3.4/32 of neutron port .* is missing from prevResult`))
+		})
+
+		It("fails CHECK when the delegate CHECK fails", func() {
+			add()
+
+			checkInput = withConfig(checkInput, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":       "noop",
+					"fail_check": true,
+				},
+			})
+			cmd = cniCommand("CHECK", checkInput)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`noop CHECK failed`))
+		})
+
+		It("rejects CHECK before CNI 0.4.0", func() {
+			checkInput = withConfig(checkInput, map[string]interface{}{
+				"cniVersion": "0.3.1",
+			})
+			cmd = cniCommand("CHECK", checkInput)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+		})
+	})
+
+	Context("empty network cleanup", func() {
+		addAndDel := func() {
+			for _, command := range []string{"ADD", "DEL"} {
+				cmd = cniCommand(command, input)
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+			}
+		}
+
+		BeforeEach(func() {
+			input = withConfig(input, map[string]interface{}{
+				"delete_empty_networks": true,
+			})
+		})
+
+		It("deletes the subnet and network once the last container is gone", func() {
+			addAndDel()
+
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("keeps networks that still have compute ports", func() {
+			neutron.ports.networkPorts = `[
+  { "id": "some-dhcp-port", "device_owner": "network:dhcp" },
+  { "id": "some-other-port", "device_owner": "compute:gofer" }
+]`
+			addAndDel()
+
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeZero())
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeZero())
+		})
+
+		It("keeps networks that still have container ports of other hosts", func() {
+			neutron.ports.networkPorts = `[
+  { "id": "some-dhcp-port", "device_owner": "network:dhcp" },
+  { "id": "some-other-port", "device_owner": "gofer:container" }
+]`
+			addAndDel()
+
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeZero())
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeZero())
+		})
+
+		It("keeps networks when not configured to delete them", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delete_empty_networks": false,
+			})
+			addAndDel()
+
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeZero())
+		})
+
+		It("detaches the subnet from the org router first", func() {
+			input = withConfig(input, map[string]interface{}{
+				"manage_routers": true,
+			})
+			addAndDel()
+
+			Expect(neutron.routers.interfaces).To(BeEmpty())
+			Expect(neutron.routers.ids).To(BeEmpty())
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("attaches the subnet again when another host creates a port before the delete", func() {
+			input = withConfig(input, map[string]interface{}{
+				"manage_routers": true,
+			})
+			neutron.subnets.inUse = true
+			addAndDel()
+
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeZero())
+			Expect(neutron.routers.ids).To(HaveLen(1))
+			Expect(neutron.routers.interfaces).To(Equal(map[string]string{
+				"cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6": neutron.routers.ids[0],
+			}))
+		})
+	})
+
+	Context("gc", func() {
+		var configFile string
+
+		gcCommand := func(args ...string) *exec.Cmd {
+			args = append([]string{"gc", "-config", configFile, "-grace-period", "1m"}, args...)
+			return exec.Command(paths.PathToPlugin, args...)
+		}
+
+		writeFile := func(name, content string, age time.Duration) {
+			path := filepath.Join(stateDir, name)
+			Expect(ioutil.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			modTime := time.Now().Add(-age)
+			Expect(os.Chtimes(path, modTime, modTime)).To(Succeed())
+		}
+
+		stateFiles := func() []string {
+			files, err := ioutil.ReadDir(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name())
+			}
+			return names
+		}
+
+		BeforeEach(func() {
+			f, err := ioutil.TempFile("", "gofer.conf")
+			Expect(err).NotTo(HaveOccurred())
+			configFile = f.Name()
+			_, err = f.WriteString(input)
+			Expect(err).NotTo(HaveOccurred())
+			f.Close()
+
+			writeFile("dead-container", `{"ip": "10.0.1.10", "neutron_port_id": "dead-port"}`, time.Hour)
+			writeFile("live-container", `{"ip": "10.0.1.11", "neutron_port_id": "live-port"}`, time.Hour)
+			writeFile("new-container", `{"ip": "10.0.1.12", "neutron_port_id": "new-port"}`, 0)
+			writeFile(".network-some-space.lock", "", time.Hour)
+			writeFile("policies.yml", "policies: []", time.Hour)
+
+			neutron.ports.hostPorts = fmt.Sprintf(`[
+  { "id": "dead-port", "device_id": "dead-container", "created_at": "2017-01-01T00:00:00Z" },
+  { "id": "live-port", "device_id": "live-container", "created_at": "2017-01-01T00:00:00Z" },
+  { "id": "new-port", "device_id": "new-container", "created_at": "%s" }
+]`, time.Now().UTC().Format(time.RFC3339))
+		})
+
+		AfterEach(func() {
+			os.Remove(configFile)
+		})
+
+		It("removes the ports and state files of containers that are gone", func() {
+			cmd = gcCommand("-stdin")
+			cmd.Stdin = strings.NewReader("live-container\n")
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.tags).To(Equal("gofer,host:some-host"))
+			Expect(neutron.ports.deviceOwners).To(ConsistOf("gofer:container", "compute:gofer"))
+			Expect(neutron.ports.deleted).To(ConsistOf("dead-port"))
+			files := stateFiles()
+			for _, kept := range []string{"live-container", "new-container", ".network-some-space.lock", "policies.yml"} {
+				Expect(files).To(ContainElement(kept))
+			}
+			Expect(files).NotTo(ContainElement("dead-container"))
+			Expect(session.Out).To(gbytes.Say(`\? policies.yml is not container state, skipping\n`))
+		})
+
+		It("only prints the orphans on a dry run", func() {
+			cmd = gcCommand("-stdin", "-dry-run")
+			cmd.Stdin = strings.NewReader("live-container\n")
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Out).To(gbytes.Say(`- state dead-container\n`))
+			Expect(session.Out).To(gbytes.Say(`- port dead-port of container dead-container\n`))
+			Expect(neutron.ports.deleted).To(BeEmpty())
+			Expect(stateFiles()).To(ContainElement("dead-container"))
+		})
+
+		It("refuses to collect every container when none are listed as live", func() {
+			cmd = gcCommand("-stdin")
+			cmd.Stdin = strings.NewReader("")
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`no live containers listed, pass -allow-empty`))
+
+			Expect(neutron.ports.deleted).To(BeEmpty())
+			Expect(stateFiles()).To(ContainElement("dead-container"))
+			Expect(stateFiles()).To(ContainElement("live-container"))
+		})
+
+		It("collects every container when none are live and that is allowed", func() {
+			cmd = gcCommand("-stdin", "-allow-empty")
+			cmd.Stdin = strings.NewReader("")
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.deleted).To(ConsistOf("dead-port", "live-port"))
+			Expect(stateFiles()).To(ContainElement("new-container"))
+			Expect(stateFiles()).NotTo(ContainElement("live-container"))
+		})
+
+		It("requires the live containers to be read from stdin or a garden server", func() {
+			session, err := gexec.Start(gcCommand(), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`gofer gc: gc requires one of -stdin or -garden-url`))
+			Expect(neutron.ports.deleted).To(BeEmpty())
+		})
+
+		It("lists the live containers from a garden server", func() {
+			gardenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				Expect(r.URL.Path).To(Equal("/containers"))
+				w.Write([]byte(`{ "Handles": ["live-container"] }`))
+			}))
+			defer gardenServer.Close()
+
+			session, err := gexec.Start(gcCommand("-garden-url", gardenServer.URL), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.deleted).To(ConsistOf("dead-port"))
+			Expect(stateFiles()).NotTo(ContainElement("dead-container"))
+		})
+	})
+
+	Context("peers", func() {
+		var configFile, hostsFile string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "peers")
+			Expect(err).NotTo(HaveOccurred())
+			configFile = filepath.Join(dir, "gofer.conf")
+			hostsFile = filepath.Join(dir, "hosts.yml")
+			Expect(ioutil.WriteFile(configFile, []byte(input), 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(hostsFile, []byte("some-host: 10.0.16.5\nother-host: 10.0.16.6\nidle-host: 10.0.16.7\n"), 0600)).To(Succeed())
+
+			neutron.ports.hostPorts = `[
+  { "id": "bound-port", "mac_address": "fa:16:3e:00:00:02", "network_id": "some-network",
+    "fixed_ips": [ { "ip_address": "10.255.96.2", "subnet_id": "some-subnet" } ],
+    "binding:host_id": "other-host", "tags": [ "gofer", "host:some-host" ] },
+  { "id": "tagged-port", "mac_address": "fa:16:3e:00:00:01", "network_id": "some-network",
+    "fixed_ips": [ { "ip_address": "10.255.96.1", "subnet_id": "some-subnet" } ],
+    "binding:host_id": "", "tags": [ "gofer", "host:some-host" ] },
+  { "id": "stray-port", "mac_address": "fa:16:3e:00:00:03", "network_id": "some-network",
+    "fixed_ips": [ { "ip_address": "10.255.96.3", "subnet_id": "some-subnet" } ],
+    "binding:host_id": "gone-host", "tags": [ "gofer" ] }
+]`
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(configFile))
+		})
+
+		It("prints the container ports of each host", func() {
+			cmd = exec.Command(paths.PathToPlugin, "peers", "-config", configFile, "-hosts", hostsFile)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.ports.tags).To(Equal("gofer"))
+			Expect(neutron.ports.deviceOwners).To(ConsistOf("gofer:container", "compute:gofer"))
+			Expect(session.Err).To(gbytes.Say(`skipping port stray-port of unknown host "gone-host"`))
+			Expect(session.Out.Contents()).To(MatchJSON(`{
+  "peers": [
+    { "host_id": "idle-host", "ip": "10.0.16.7", "ports": [] },
+    { "host_id": "other-host", "ip": "10.0.16.6", "ports": [
+      { "mac_address": "fa:16:3e:00:00:02", "ip": "10.255.96.2", "segmentation_id": 1001 }
+    ] },
+    { "host_id": "some-host", "ip": "10.0.16.5", "ports": [
+      { "mac_address": "fa:16:3e:00:00:01", "ip": "10.255.96.1", "segmentation_id": 1001 }
+    ] }
+  ]
+}`))
+		})
+
+		It("skips the ports of networks without a segmentation ID", func() {
+			neutron.networks.segmentationID = "null"
+
+			cmd = exec.Command(paths.PathToPlugin, "peers", "-config", configFile, "-hosts", hostsFile)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Err).To(gbytes.Say(`skipping ports of neutron network some-network without provider:segmentation_id\n`))
+			Expect(session.Err).NotTo(gbytes.Say(`some-network`))
+			Expect(session.Out.Contents()).To(MatchJSON(`{
+  "peers": [
+    { "host_id": "idle-host", "ip": "10.0.16.7", "ports": [] },
+    { "host_id": "other-host", "ip": "10.0.16.6", "ports": [] },
+    { "host_id": "some-host", "ip": "10.0.16.5", "ports": [] }
+  ]
+}`))
+		})
+
+		It("requires the hosts", func() {
+			cmd = exec.Command(paths.PathToPlugin, "peers", "-config", configFile)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`gofer peers: peers requires -config and -hosts`))
+		})
+	})
+
+	Context("policy-sync", func() {
+		var configFile, policiesFile string
+
+		const policies = `
+policies:
+- source: { id: frontend-app }
+  destination: { id: backend-app, protocol: tcp, ports: { start: 8080, end: 8080 } }
+`
+
+		const staleRule = `[{
+  "id": "stale-rule",
+  "security_group_id": "secgroup-1",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "protocol": "tcp",
+  "port_range_min": 9000,
+  "port_range_max": 9000,
+  "remote_group_id": "secgroup-1",
+  "description": "gofer policy-sync"
+}]`
+
+		policySyncCommand := func(args ...string) *exec.Cmd {
+			args = append([]string{"policy-sync", "-config", configFile, "-policies", policiesFile}, args...)
+			return exec.Command(paths.PathToPlugin, args...)
+		}
+
+		BeforeEach(func() {
+			configFile = filepath.Join(stateDir, "gofer.conf")
+			Expect(ioutil.WriteFile(configFile, []byte(input), 0600)).To(Succeed())
+			policiesFile = filepath.Join(stateDir, "policies.yml")
+			Expect(ioutil.WriteFile(policiesFile, []byte(policies), 0600)).To(Succeed())
+
+			neutron.securityGroups.ids = []string{"secgroup-1"}
+			neutron.securityGroups.names["secgroup-1"] = "frontend-app"
+			neutron.securityGroups.rules = staleRule
+		})
+
+		It("prints the rule changes without applying them on a dry run", func() {
+			session, err := gexec.Start(policySyncCommand("-dry-run"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Out).To(gbytes.Say(`\+ security group backend-app\n`))
+			Expect(session.Out).To(gbytes.Say(`\+ IPv4 tcp 8080 from frontend-app to backend-app\n`))
+			Expect(session.Out).To(gbytes.Say(`\+ IPv6 tcp 8080 from frontend-app to backend-app\n`))
+			Expect(session.Out).To(gbytes.Say(`- IPv4 tcp 9000 from frontend-app to frontend-app\n`))
+
+			Expect(neutron.securityGroups.ids).To(ConsistOf("secgroup-1"))
+			Expect(neutron.securityGroups.ruleRequests).To(BeEmpty())
+			Expect(neutron.securityGroups.rulesDeleted).To(BeEmpty())
+		})
+
+		It("reconciles the policies into security group rules", func() {
+			session, err := gexec.Start(policySyncCommand("-interval", "1h"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Kill()
+
+			Eventually(func() []string {
+				neutron.securityGroups.Lock()
+				defer neutron.securityGroups.Unlock()
+				return neutron.securityGroups.rulesDeleted
+			}).Should(ConsistOf("stale-rule"))
+
+			neutron.securityGroups.Lock()
+			defer neutron.securityGroups.Unlock()
+			Expect(neutron.securityGroups.names).To(HaveKeyWithValue("secgroup-2", "backend-app"))
+			Expect(neutron.securityGroups.ruleRequests).To(HaveLen(4))
+			Expect(neutron.securityGroups.ruleRequests[2]).To(MatchJSON(`{
+  "security_group_id": "secgroup-2",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "protocol": "tcp",
+  "port_range_min": 8080,
+  "port_range_max": 8080,
+  "remote_group_id": "secgroup-1",
+  "description": "gofer policy-sync"
+}`))
+		})
+
+		It("leaves rules that are already in place alone", func() {
+			neutron.securityGroups.rules = `[{
+  "id": "existing-rule",
+  "security_group_id": "secgroup-1",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "protocol": "tcp",
+  "port_range_min": 8080,
+  "port_range_max": 8080,
+  "remote_group_id": "secgroup-1",
+  "description": "gofer policy-sync"
+}]`
+			Expect(ioutil.WriteFile(policiesFile, []byte(`{"policies": [{"source": {"id": "frontend-app"}, "destination": {"id": "frontend-app", "protocol": "tcp", "port": 8080}}]}`), 0600)).To(Succeed())
+
+			session, err := gexec.Start(policySyncCommand("-dry-run"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(session.Out).To(gbytes.Say(`\+ IPv6 tcp 8080 from frontend-app to frontend-app\n`))
+			Expect(session.Out).NotTo(gbytes.Say(`IPv4`))
+		})
+
+		It("leaves the policy-sync rules of other clusters alone", func() {
+			input = withConfig(input, map[string]interface{}{
+				"cluster_id": "cf-prod",
+			})
+			Expect(ioutil.WriteFile(configFile, []byte(input), 0600)).To(Succeed())
+
+			neutron.securityGroups.ids = []string{"secgroup-1", "secgroup-2"}
+			neutron.securityGroups.names["secgroup-2"] = "staging-app"
+			neutron.securityGroups.clusters["secgroup-1"] = "cf-prod"
+			neutron.securityGroups.clusters["secgroup-2"] = "cf-staging"
+			neutron.securityGroups.rules = `[{
+  "id": "stale-rule",
+  "security_group_id": "secgroup-1",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "protocol": "tcp",
+  "port_range_min": 9000,
+  "port_range_max": 9000,
+  "remote_group_id": "secgroup-1",
+  "description": "gofer policy-sync"
+}, {
+  "id": "staging-rule",
+  "security_group_id": "secgroup-2",
+  "direction": "ingress",
+  "ethertype": "IPv4",
+  "protocol": "tcp",
+  "port_range_min": 9000,
+  "port_range_max": 9000,
+  "remote_group_id": "secgroup-2",
+  "description": "gofer policy-sync"
+}]`
+
+			session, err := gexec.Start(policySyncCommand("-interval", "1h"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			defer session.Kill()
+
+			Eventually(func() []string {
+				neutron.securityGroups.Lock()
+				defer neutron.securityGroups.Unlock()
+				return neutron.securityGroups.rulesDeleted
+			}).Should(ConsistOf("stale-rule"))
+			Consistently(func() []string {
+				neutron.securityGroups.Lock()
+				defer neutron.securityGroups.Unlock()
+				return neutron.securityGroups.rulesDeleted
+			}, "500ms").Should(ConsistOf("stale-rule"))
+		})
+
+		It("rejects policies with an invalid protocol", func() {
+			Expect(ioutil.WriteFile(policiesFile, []byte(`{"policies": [{"source": {"id": "a"}, "destination": {"id": "b", "protocol": "sctp", "port": 80}}]}`), 0600)).To(Succeed())
+
+			session, err := gexec.Start(policySyncCommand("-dry-run"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say(`invalid protocol "sctp"`))
+		})
+	})
+
+	Context("org routers", func() {
+		BeforeEach(func() {
+			input = withConfig(input, map[string]interface{}{
+				"manage_routers":      true,
+				"external_network_id": "some-external-network-id",
+			})
+		})
+
+		It("creates a router for the org and attaches the space subnet", func() {
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.routers.request).To(MatchJSON(`{
+  "name": "2ac41bbf-8eae-4f28-abab-51ca38dea3e4",
+  "admin_state_up": true,
+  "external_gateway_info": { "network_id": "some-external-network-id" },
+  "tags": ["gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4"]
+}`))
+			Expect(neutron.routers.ids).To(ConsistOf("router-1"))
+			Expect(neutron.routers.interfaces).To(Equal(map[string]string{
+				"cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6": "router-1",
+			}))
+		})
+
+		It("reuses the router of an org that already has one", func() {
+			neutron.routers.ids = []string{"router-0"}
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(neutron.routers.request).To(BeNil())
+			Expect(neutron.routers.interfaces).To(Equal(map[string]string{
+				"cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6": "router-0",
+			}))
+		})
+
+		It("detaches the subnet and removes the unused router on rollback", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":     "noop",
+					"fail_add": true,
+				},
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+
+			Expect(neutron.routers.interfaces).To(BeEmpty())
+			Expect(neutron.routers.ids).To(BeEmpty())
+			Expect(atomic.LoadInt32(&neutron.routers.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("dual-stack", func() {
+		It("creates an IPv6 subnet and returns both addresses", func() {
+			neutron.ports.dualStack = true
+			input = withConfig(input, map[string]interface{}{
+				"ipv6_mode":     "slaac",
+				"ipv6_supernet": "fd00:64::/48",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+			Expect(session.Out.Contents()).To(MatchJSON(`{
+  "cniVersion": "0.2.0",
+  "ip4": {
+    "ip": "1.2.3.4/32",
+    "gateway": "10.0.3.1",
+    "routes": [ { "dst": "10.0.3.0/24" }, { "dst": "0.0.0.0/0", "gw": "10.0.3.1" } ]
+  },
+  "ip6": {
+    "ip": "fd00:64::f816:3eff:fea6:50c1/128",
+    "gateway": "fd00:64::1",
+    "routes": [ { "dst": "fd00:64::/64" }, { "dst": "::/0", "gw": "fd00:64::1" } ]
+  },
+  "dns": {}
+}`))
+
+			By("creating an IPv6 subnet next to the IPv4 one")
+			Expect(neutron.subnets.requests).To(HaveLen(2))
+			Expect(neutron.subnets.requests[1]).To(MatchJSON(`{
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001",
+  "ip_version": 6,
+  "cidr": "fd00:64::/64",
+  "ipv6_ra_mode": "slaac",
+  "ipv6_address_mode": "slaac",
+  "tags": ["gofer", "org_id:2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "space_id:4246c57d-aefc-49cc-afe0-5f734e2656e8"]
+}`))
+
+			By("recording both addresses in the container state")
+			data, err := ioutil.ReadFile(filepath.Join(stateDir, "some-container-id"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(`{
+  "ip": "1.2.3.4/32",
+  "ip6": "fd00:64::f816:3eff:fea6:50c1/128",
+  "neutron_port_id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
+  "network_id": "cc6c1929-6b26-4a1a-8680-000000000001"
+}`))
+		})
+
+		It("rejects an invalid IPv6 mode", func() {
+			input = withConfig(input, map[string]interface{}{
+				"ipv6_mode":     "dhcpv6-stateless",
+				"ipv6_supernet": "fd00:64::/48",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`invalid 'ipv6_mode'`))
+		})
+	})
+
+	Context("ADD failures", func() {
+		It("rolls back the port, subnet and network when the delegate fails", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":     "noop",
+					"fail_add": true,
+				},
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`noop ADD failed`))
+
+			Expect(atomic.LoadInt32(&neutron.ports.created)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.ports.live)).To(BeEquivalentTo(0))
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("rolls back when the container state can not be saved", func() {
+			By("making the state file path unwritable")
+			Expect(os.Mkdir(filepath.Join(stateDir, "some-container-id"), 0755)).To(Succeed())
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).NotTo(gbytes.Say(`ip4`))
+
+			Expect(atomic.LoadInt32(&neutron.ports.live)).To(BeEquivalentTo(0))
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+
+		It("reports resources it failed to roll back", func() {
+			input = withConfig(input, map[string]interface{}{
+				"delegate": map[string]interface{}{
+					"type":     "noop",
+					"fail_add": true,
+				},
+			})
+			neutron.ports.failDeletes = true
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`noop ADD failed.*rollback failed: delete port ebe69f1e-bc26-4db5-bed0-c0afb4afe3db`))
+
+			By("still removing the subnet and network")
+			Expect(atomic.LoadInt32(&neutron.subnets.deleted)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("keystone token cache", func() {
+		It("reuses a cached token across invocations", func() {
+			By("calling ADD")
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("calling DEL")
+			cmd = cniCommand("DEL", input)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("checking keystone was only asked for a token once")
+			Expect(atomic.LoadInt32(&keystoneRequests)).To(BeEquivalentTo(1))
+
+			By("checking the cached token is only readable by its owner")
+			info, err := os.Stat(filepath.Join(stateDir, ".keystone-token"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+		})
+
+		It("fetches a new token when neutron rejects the cached one", func() {
+			By("calling ADD to cache a token")
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			By("revoking the cached token")
+			neutron.rejectedToken = "fake-token-1"
+
+			By("calling DEL")
+			cmd = cniCommand("DEL", input)
+			session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&keystoneRequests)).To(BeEquivalentTo(2))
+		})
+
+		It("retries only the rejected request when the token is revoked during ADD", func() {
+			neutron.revokeTokenOn = "POST /v2.0/ports"
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(atomic.LoadInt32(&keystoneRequests)).To(BeEquivalentTo(2))
+			Expect(atomic.LoadInt32(&neutron.rejected)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.created)).To(BeEquivalentTo(1))
+			Expect(atomic.LoadInt32(&neutron.networks.deleted)).To(BeZero())
+			Expect(atomic.LoadInt32(&neutron.ports.created)).To(BeEquivalentTo(1))
+		})
+
+		It("keeps the cached token when another error mentions 401", func() {
+			By("recording a port whose ID contains 401")
+			Expect(ioutil.WriteFile(filepath.Join(stateDir, "some-container-id"),
+				[]byte(`{ "ip": "1.2.3.4/32", "neutron_port_id": "40159a3c-8f2e-4b7d-9c1a-2e5f6a7b8c9d" }`), 0644)).To(Succeed())
+			neutron.ports.failDeletes = true
+
+			cmd = cniCommand("DEL", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`neutron returned 500`))
+
+			Expect(atomic.LoadInt32(&keystoneRequests)).To(BeEquivalentTo(1))
+		})
+	})
+
+	Context("keystone project scope", func() {
+		It("requests a token scoped to the configured project", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_user_domain":    "users",
+				"keystone_project":        "cf",
+				"keystone_project_domain": "projects",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["password"],
+  "password": {
+    "user": { "name": "admin", "domain": { "name": "users" }, "password": "secret" }
+  }
+}`))
+			Expect(keystoneScope).To(MatchJSON(`{
+  "project": { "name": "cf", "domain": { "name": "projects" } }
+}`))
+		})
+
+		It("requests a token scoped to the configured project id", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_project_id": "some-project-id",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneScope).To(MatchJSON(`{ "project": { "id": "some-project-id" } }`))
+		})
+
+		It("fails clearly when keystone rejects the scope", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_project": "rejected-project",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`keystone rejected token scope project .*rejected-project`))
+		})
+	})
+
+	Context("keystone auth methods", func() {
+		It("authenticates with an application credential", func() {
+			conf := map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(input), &conf)).To(Succeed())
+			delete(conf, "keystone_username")
+			delete(conf, "keystone_password")
+			conf["keystone_auth_type"] = "application_credential"
+			conf["keystone_application_credential_id"] = "some-app-cred-id"
+			conf["keystone_application_credential_secret"] = "some-app-cred-secret"
+			data, err := json.Marshal(conf)
+			Expect(err).NotTo(HaveOccurred())
+
+			cmd = cniCommand("ADD", string(data))
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["application_credential"],
+  "application_credential": { "id": "some-app-cred-id", "secret": "some-app-cred-secret" }
+}`))
+			Expect(keystoneScope).To(BeEmpty())
+		})
+
+		It("fails when the application credential is rejected", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_auth_type":                     "application_credential",
+				"keystone_application_credential_id":     "some-app-cred-id",
+				"keystone_application_credential_secret": "wrong-secret",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`error calling keystone: 401`))
+		})
+
+		It("requests a trust-scoped token", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_auth_type": "trust",
+				"keystone_trust_id":  "some-trust-id",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["password"],
+  "password": {
+    "user": { "name": "admin", "domain": { "name": "Default" }, "password": "secret" }
+  }
+}`))
+			Expect(keystoneScope).To(MatchJSON(`{ "OS-TRUST:trust": { "id": "some-trust-id" } }`))
+		})
+
+		It("fails clearly when keystone rejects the trust", func() {
+			input = withConfig(input, map[string]interface{}{
+				"keystone_auth_type": "trust",
+				"keystone_trust_id":  "rejected-trust",
+			})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`keystone rejected token scope trust .*rejected-trust`))
+		})
+	})
+
+	Context("environment credentials", func() {
+		It("ignores OS_* variables when the config has credentials", func() {
+			cmd = cniCommand("ADD", input)
+			cmd.Env = append(cmd.Env, "OS_PROJECT_NAME=some-other-project")
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneScope).To(BeEmpty())
+		})
+
+		Context("without credentials in the config", func() {
+			BeforeEach(func() {
+				conf := map[string]interface{}{}
+				Expect(json.Unmarshal([]byte(input), &conf)).To(Succeed())
+				delete(conf, "keystone_url")
+				delete(conf, "keystone_username")
+				delete(conf, "keystone_password")
+				data, err := json.Marshal(conf)
+				Expect(err).NotTo(HaveOccurred())
+				input = string(data)
+			})
+
+			It("reads them from OS_* variables", func() {
+				cmd = cniCommand("ADD", input)
+				cmd.Env = append(cmd.Env, "OS_AUTH_URL="+keystoneServer.URL, "OS_USERNAME=admin", "OS_PASSWORD=secret")
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+			})
+
+			It("reads them from the clouds.yaml cloud named by OS_CLOUD", func() {
+				cloudsFile := filepath.Join(stateDir, "clouds.yaml")
+				clouds := fmt.Sprintf("clouds:\n  cf:\n    auth:\n      auth_url: %s\n      username: admin\n      password: secret\n", keystoneServer.URL)
+				Expect(ioutil.WriteFile(cloudsFile, []byte(clouds), 0600)).To(Succeed())
+
+				cmd = cniCommand("ADD", input)
+				cmd.Env = append(cmd.Env, "OS_CLOUD=cf", "OS_CLIENT_CONFIG_FILE="+cloudsFile)
+				session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(session).Should(gexec.Exit(0))
+
+				Expect(keystoneIdentity).To(ContainSubstring(`"name":"admin"`))
+			})
+		})
+	})
+
+	Context("credentials file", func() {
+		var (
+			credentialsFile string
+			conf            map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			credentialsFile = filepath.Join(stateDir, "credentials")
+
+			conf = map[string]interface{}{}
+			Expect(json.Unmarshal([]byte(input), &conf)).To(Succeed())
+			delete(conf, "keystone_url")
+			delete(conf, "keystone_username")
+			delete(conf, "keystone_password")
+			conf["credentials_file"] = credentialsFile
+			data, err := json.Marshal(conf)
+			Expect(err).NotTo(HaveOccurred())
+			input = string(data)
+		})
+
+		It("loads keystone settings from an openrc style file", func() {
+			openrc := fmt.Sprintf(`# generated for the cell
+export OS_AUTH_URL=%s
+export OS_USERNAME="admin"
+export OS_PASSWORD='secret'
+export OS_USER_DOMAIN_NAME=users
+export OS_PROJECT_NAME=cf
+`, keystoneServer.URL)
+			Expect(ioutil.WriteFile(credentialsFile, []byte(openrc), 0600)).To(Succeed())
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["password"],
+  "password": {
+    "user": { "name": "admin", "domain": { "name": "users" }, "password": "secret" }
+  }
+}`))
+			Expect(keystoneScope).To(MatchJSON(`{
+  "project": { "name": "cf", "domain": { "name": "users" } }
+}`))
+		})
+
+		It("loads keystone settings from a JSON file", func() {
+			creds := fmt.Sprintf(`{
+  "keystone_url": "%s",
+  "keystone_auth_type": "application_credential",
+  "keystone_application_credential_id": "some-app-cred-id",
+  "keystone_application_credential_secret": "some-app-cred-secret"
+}`, keystoneServer.URL)
+			Expect(ioutil.WriteFile(credentialsFile, []byte(creds), 0600)).To(Succeed())
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["application_credential"],
+  "application_credential": { "id": "some-app-cred-id", "secret": "some-app-cred-secret" }
+}`))
+		})
+
+		It("loads keystone settings from a clouds.yaml", func() {
+			clouds := fmt.Sprintf(`clouds:
+  other:
+    auth:
+      auth_url: https://other.example.com:5000
+      username: other
+      password: other-secret
+  cf:
+    auth:
+      auth_url: %s
+      username: admin
+      password: secret
+      user_domain_name: users
+      project_name: cf
+`, keystoneServer.URL)
+			Expect(ioutil.WriteFile(credentialsFile, []byte(clouds), 0600)).To(Succeed())
+			input = withConfig(input, map[string]interface{}{"cloud": "cf"})
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(0))
+
+			Expect(keystoneIdentity).To(MatchJSON(`{
+  "methods": ["password"],
+  "password": {
+    "user": { "name": "admin", "domain": { "name": "users" }, "password": "secret" }
+  }
+}`))
+			Expect(keystoneScope).To(MatchJSON(`{
+  "project": { "name": "cf", "domain": { "name": "users" } }
+}`))
+		})
+
+		It("refuses a file readable by group or others", func() {
+			openrc := fmt.Sprintf("OS_AUTH_URL=%s\nOS_USERNAME=admin\nOS_PASSWORD=secret\n", keystoneServer.URL)
+			Expect(ioutil.WriteFile(credentialsFile, []byte(openrc), 0644)).To(Succeed())
+			Expect(os.Chmod(credentialsFile, 0644)).To(Succeed())
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`must not be group or world accessible`))
+			Expect(atomic.LoadInt32(&keystoneRequests)).To(BeEquivalentTo(0))
+		})
+
+		It("redacts secrets from errors", func() {
+			openrc := fmt.Sprintf("OS_AUTH_URL=%s\nOS_USERNAME=admin\nOS_PASSWORD=echo-me\n", keystoneServer.URL)
+			Expect(ioutil.WriteFile(credentialsFile, []byte(openrc), 0600)).To(Succeed())
+
+			cmd = cniCommand("ADD", input)
+			session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(1))
+			Expect(session.Out).To(gbytes.Say(`\[REDACTED\]`))
+			Expect(string(session.Out.Contents())).NotTo(ContainSubstring("echo-me"))
+		})
+	})
 })
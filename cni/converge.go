@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// pickOldest returns the index of the first created of count resources
+// sharing a name, given the created_at and ID of each. The lock of a
+// resource only serializes the processes of one host, so hosts that race to
+// create it may each create one. Each of them lists the resources by name
+// again after creating its own and keeps the oldest, deleting its own if
+// another is older. That way they agree on one: once a resource exists no
+// host creates another. IDs only break ties between resources created
+// within the same second.
+func pickOldest(count int, resource func(i int) (createdAt, id string)) int {
+	winner := 0
+	winnerCreated, winnerID := resource(0)
+	for i := 1; i < count; i++ {
+		created, id := resource(i)
+		t, winnerT := parseCreatedAt(created), parseCreatedAt(winnerCreated)
+		if t.Before(winnerT) || (t.Equal(winnerT) && id < winnerID) {
+			winner, winnerCreated, winnerID = i, created, id
+		}
+	}
+	return winner
+}
+
+// parseCreatedAt parses Neutron's created_at, which is missing before the
+// Mitaka release. Resources without one are ordered by ID alone.
+func parseCreatedAt(createdAt string) time.Time {
+	t, err := time.Parse(time.RFC3339, createdAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/ghodss/yaml"
+)
+
+// credentials are the Keystone settings that may be kept out of the CNI
+// config, either in a root-only 'credentials_file' or in the environment. The
+// file is either JSON using the same keys as the CNI config, a clouds.yaml,
+// or an openrc style list of OS_* assignments.
+type credentials struct {
+	KeystoneURL                         string `json:"keystone_url"`
+	KeystoneUsername                    string `json:"keystone_username"`
+	KeystonePassword                    string `json:"keystone_password"`
+	KeystoneUserDomain                  string `json:"keystone_user_domain"`
+	KeystoneProject                     string `json:"keystone_project"`
+	KeystoneProjectID                   string `json:"keystone_project_id"`
+	KeystoneProjectDomain               string `json:"keystone_project_domain"`
+	KeystoneAuthType                    string `json:"keystone_auth_type"`
+	KeystoneApplicationCredentialID     string `json:"keystone_application_credential_id"`
+	KeystoneApplicationCredentialSecret string `json:"keystone_application_credential_secret"`
+	KeystoneTrustID                     string `json:"keystone_trust_id"`
+}
+
+// osAuthTypes maps OS_AUTH_TYPE values to 'keystone_auth_type'
+var osAuthTypes = map[string]string{
+	"password":                authTypePassword,
+	"v3password":              authTypePassword,
+	"v3applicationcredential": authTypeApplicationCredential,
+}
+
+// fromOSVars builds credentials from OS_* variables as used by openrc files
+// and the OpenStack CLI.
+func fromOSVars(vars map[string]string) (credentials, error) {
+	c := credentials{
+		KeystoneURL:                         vars["OS_AUTH_URL"],
+		KeystoneUsername:                    vars["OS_USERNAME"],
+		KeystonePassword:                    vars["OS_PASSWORD"],
+		KeystoneUserDomain:                  vars["OS_USER_DOMAIN_NAME"],
+		KeystoneProject:                     vars["OS_PROJECT_NAME"],
+		KeystoneProjectID:                   vars["OS_PROJECT_ID"],
+		KeystoneProjectDomain:               vars["OS_PROJECT_DOMAIN_NAME"],
+		KeystoneApplicationCredentialID:     vars["OS_APPLICATION_CREDENTIAL_ID"],
+		KeystoneApplicationCredentialSecret: vars["OS_APPLICATION_CREDENTIAL_SECRET"],
+		KeystoneTrustID:                     vars["OS_TRUST_ID"],
+	}
+
+	if c.KeystoneProject == "" {
+		c.KeystoneProject = vars["OS_TENANT_NAME"]
+	}
+
+	if t, ok := vars["OS_AUTH_TYPE"]; ok {
+		authType, ok := osAuthTypes[strings.ToLower(t)]
+		if !ok {
+			return c, fmt.Errorf("unsupported OS_AUTH_TYPE %q", t)
+		}
+		c.KeystoneAuthType = authType
+	}
+	if c.KeystoneTrustID != "" && c.KeystoneAuthType == "" {
+		c.KeystoneAuthType = authTypeTrust
+	}
+	return c, nil
+}
+
+// credentialsFromEnv reads the cloud named by OS_CLOUD from the clouds.yaml
+// the OpenStack CLI would use, or else the OS_* variables themselves.
+func credentialsFromEnv() (credentials, error) {
+	if cloud := os.Getenv("OS_CLOUD"); cloud != "" {
+		for _, path := range cloudsYAMLPaths() {
+			if _, err := os.Stat(path); err == nil {
+				return loadCredentialsFile(path, cloud)
+			}
+		}
+		return credentials{}, fmt.Errorf("OS_CLOUD is set but no clouds.yaml was found in %s", strings.Join(cloudsYAMLPaths(), ", "))
+	}
+
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "OS_") {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		vars[parts[0]] = parts[1]
+	}
+	return fromOSVars(vars)
+}
+
+// cloudsYAMLPaths are the places the OpenStack CLI looks for clouds.yaml, in
+// order.
+func cloudsYAMLPaths() []string {
+	var paths []string
+	if path := os.Getenv("OS_CLIENT_CONFIG_FILE"); path != "" {
+		paths = append(paths, path)
+	}
+	paths = append(paths, "clouds.yaml")
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "openstack", "clouds.yaml"))
+	}
+	return append(paths, "/etc/openstack/clouds.yaml")
+}
+
+// loadCredentialsFile loads a credentials file. cloud picks the cloud of a
+// clouds.yaml, and may be left empty if it has only one.
+func loadCredentialsFile(path, cloud string) (credentials, error) {
+	var c credentials
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to load credentials file: %w", err)
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return c, fmt.Errorf("credentials file %s must not be group or world accessible (mode %04o)", path, info.Mode().Perm())
+	}
+
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Geteuid() {
+		return c, fmt.Errorf("credentials file %s must be owned by uid %d", path, os.Geteuid())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to load credentials file: %w", err)
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		// errors from encoding/json never include the offending values
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+		}
+		return c, nil
+	}
+
+	if cloudsYAMLRegexp.Match(data) {
+		vars, err := parseCloudsYAML(data, cloud)
+		if err != nil {
+			return c, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+		}
+		return fromOSVars(vars)
+	}
+
+	vars, err := parseOpenRC(data)
+	if err != nil {
+		return c, fmt.Errorf("failed to parse credentials file %s: %w", path, err)
+	}
+	return fromOSVars(vars)
+}
+
+// cloudsYAMLRegexp matches the top-level key of a clouds.yaml
+var cloudsYAMLRegexp = regexp.MustCompile(`(?m)^clouds:`)
+
+// cloudsYAML is the part of a clouds.yaml holding Keystone settings, see
+// https://docs.openstack.org/os-client-config/latest/user/configuration.html
+type cloudsYAML struct {
+	Clouds map[string]struct {
+		AuthType string `json:"auth_type"`
+		Auth     struct {
+			AuthURL                     string `json:"auth_url"`
+			Username                    string `json:"username"`
+			Password                    string `json:"password"`
+			UserDomainName              string `json:"user_domain_name"`
+			ProjectName                 string `json:"project_name"`
+			ProjectID                   string `json:"project_id"`
+			ProjectDomainName           string `json:"project_domain_name"`
+			ApplicationCredentialID     string `json:"application_credential_id"`
+			ApplicationCredentialSecret string `json:"application_credential_secret"`
+			TrustID                     string `json:"trust_id"`
+		} `json:"auth"`
+	} `json:"clouds"`
+}
+
+// parseCloudsYAML returns the settings of a cloud in a clouds.yaml as the
+// equivalent OS_* variables. YAML errors may quote the offending values, so
+// they are not passed on.
+func parseCloudsYAML(data []byte, cloud string) (map[string]string, error) {
+	var clouds cloudsYAML
+	if err := yaml.Unmarshal(data, &clouds); err != nil {
+		return nil, errors.New("invalid clouds.yaml")
+	}
+
+	if cloud == "" && len(clouds.Clouds) == 1 {
+		for name := range clouds.Clouds {
+			cloud = name
+		}
+	}
+	if cloud == "" {
+		return nil, errors.New("clouds.yaml has several clouds, set 'cloud' to pick one")
+	}
+	c, ok := clouds.Clouds[cloud]
+	if !ok {
+		return nil, fmt.Errorf("cloud %q not found in clouds.yaml", cloud)
+	}
+
+	vars := map[string]string{}
+	for key, value := range map[string]string{
+		"OS_AUTH_TYPE":                     c.AuthType,
+		"OS_AUTH_URL":                      c.Auth.AuthURL,
+		"OS_USERNAME":                      c.Auth.Username,
+		"OS_PASSWORD":                      c.Auth.Password,
+		"OS_USER_DOMAIN_NAME":              c.Auth.UserDomainName,
+		"OS_PROJECT_NAME":                  c.Auth.ProjectName,
+		"OS_PROJECT_ID":                    c.Auth.ProjectID,
+		"OS_PROJECT_DOMAIN_NAME":           c.Auth.ProjectDomainName,
+		"OS_APPLICATION_CREDENTIAL_ID":     c.Auth.ApplicationCredentialID,
+		"OS_APPLICATION_CREDENTIAL_SECRET": c.Auth.ApplicationCredentialSecret,
+		"OS_TRUST_ID":                      c.Auth.TrustID,
+	} {
+		if value != "" {
+			vars[key] = value
+		}
+	}
+	return vars, nil
+}
+
+// parseOpenRC reads OS_* assignments from an openrc style file. Errors only
+// mention line numbers so that secrets are never echoed back.
+func parseOpenRC(data []byte) (map[string]string, error) {
+	vars := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "export ")
+
+		if !strings.HasPrefix(line, "OS_") {
+			// comments, blank lines and anything else a shell would run
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d is not an assignment", lineNum)
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		} else if strings.Contains(value, "$") {
+			return nil, fmt.Errorf("line %d: shell expansion is not supported", lineNum)
+		}
+		vars[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("failed to read file")
+	}
+	return vars, nil
+}
+
+// loadCredentials fills in Keystone settings missing from the CNI config from
+// the credentials file. Only when neither of them has any credentials are
+// they taken from the environment, so that variables a runtime happens to
+// pass on never mix into configured credentials.
+func loadCredentials(n *NetConf) error {
+	if n.CredentialsFile != "" {
+		c, err := loadCredentialsFile(n.CredentialsFile, n.Cloud)
+		if err != nil {
+			return err
+		}
+		mergeCredentials(n, c)
+	}
+	if hasCredentials(n) {
+		return nil
+	}
+
+	c, err := credentialsFromEnv()
+	if err != nil {
+		return err
+	}
+	mergeCredentials(n, c)
+	return nil
+}
+
+func hasCredentials(n *NetConf) bool {
+	for _, s := range []string{
+		n.KeystoneURL,
+		n.KeystoneUsername,
+		n.KeystonePassword,
+		n.KeystoneApplicationCredentialID,
+		n.KeystoneApplicationCredentialSecret,
+	} {
+		if s != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeCredentials(n *NetConf, c credentials) {
+	fill := func(dst *string, src string) {
+		if *dst == "" {
+			*dst = src
+		}
+	}
+	fill(&n.KeystoneURL, c.KeystoneURL)
+	fill(&n.KeystoneUsername, c.KeystoneUsername)
+	fill(&n.KeystonePassword, c.KeystonePassword)
+	fill(&n.KeystoneUserDomain, c.KeystoneUserDomain)
+	fill(&n.KeystoneProject, c.KeystoneProject)
+	fill(&n.KeystoneProjectID, c.KeystoneProjectID)
+	fill(&n.KeystoneProjectDomain, c.KeystoneProjectDomain)
+	fill(&n.KeystoneAuthType, c.KeystoneAuthType)
+	fill(&n.KeystoneApplicationCredentialID, c.KeystoneApplicationCredentialID)
+	fill(&n.KeystoneApplicationCredentialSecret, c.KeystoneApplicationCredentialSecret)
+	fill(&n.KeystoneTrustID, c.KeystoneTrustID)
+}
+
+// redactSecrets hides secrets from errors returned to the container runtime,
+// which typically logs them.
+func redactSecrets(err error, n *NetConf) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+	for _, secret := range []string{n.KeystonePassword, n.KeystoneApplicationCredentialSecret} {
+		if secret != "" {
+			msg = strings.Replace(msg, secret, "[REDACTED]", -1)
+		}
+	}
+	return errors.New(msg)
+}
@@ -0,0 +1,667 @@
+package main_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const portJSON = `{
+        "admin_state_up": true,
+        "device_id": "d6b4d3a5-c700-476f-b609-1493dd9dadc0",
+        "device_owner": "",
+        "fixed_ips": [
+            {
+                "ip_address": "1.2.3.4",
+                "subnet_id": "22b44fc2-4ffb-4de4-b0f9-69d58b37ae27"
+            }
+        ],
+        "id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
+        "mac_address": "fa:16:3e:a6:50:c1",
+        "name": "some-container-id",
+        "network_id": "6aeaf34a-c482-4bd3-9dc3-7faf36412f12",
+        "status": "ACTIVE",
+        "tenant_id": "cf1a5775e766426cb1968766d0191908"
+    }`
+
+const dualStackPortJSON = `{
+        "admin_state_up": true,
+        "fixed_ips": [
+            {
+                "ip_address": "1.2.3.4",
+                "subnet_id": "22b44fc2-4ffb-4de4-b0f9-69d58b37ae27"
+            },
+            {
+                "ip_address": "fd00:64::f816:3eff:fea6:50c1",
+                "subnet_id": "83a8b5d3-1a6f-4e0e-9e27-4a1a0a4b7c6e"
+            }
+        ],
+        "id": "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
+        "mac_address": "fa:16:3e:a6:50:c1",
+        "name": "some-container-id",
+        "network_id": "6aeaf34a-c482-4bd3-9dc3-7faf36412f12",
+        "status": "ACTIVE"
+    }`
+
+const subnetResp = `{
+  "subnet": {
+    "id": "22b44fc2-4ffb-4de4-b0f9-69d58b37ae27",
+    "ip_version": 4,
+    "cidr": "10.0.3.0/24",
+    "gateway_ip": "10.0.3.1",
+    "host_routes": %s,
+    "dns_nameservers": %s
+  }
+}`
+
+const subnet6Resp = `{
+  "subnet": {
+    "id": "83a8b5d3-1a6f-4e0e-9e27-4a1a0a4b7c6e",
+    "ip_version": 6,
+    "cidr": "fd00:64::/64",
+    "gateway_ip": "fd00:64::1",
+    "host_routes": [],
+    "dns_nameservers": []
+  }
+}`
+
+const unauthorizedResp = `{
+  "error": {
+    "message": "The request you have made requires authentication.",
+    "code": 401,
+    "title": "Unauthorized"
+  }
+}`
+
+// fakeNeutron serves the parts of the Neutron API the plugin uses. Each
+// resource keeps its own state, which tests set up before running the
+// plugin and inspect afterwards.
+type fakeNeutron struct {
+	*httptest.Server
+
+	// requests with this token are rejected as unauthorized, and counted
+	rejectedToken string
+	rejected      int32
+
+	// a request, such as "POST /v2.0/ports", that revokes the token it
+	// carries before it is served
+	revokeTokenOn string
+
+	networks       fakeNetworks
+	subnets        fakeSubnets
+	ports          fakePorts
+	routers        fakeRouters
+	securityGroups fakeSecurityGroups
+}
+
+type fakeNetworks struct {
+	sync.Mutex
+	ids       []string
+	createdAt map[string]string
+	created   int32
+	deleted   int32
+	lookups   int32
+
+	// the last network created, and the tags networks were listed by
+	request []byte
+	tags    string
+
+	// a network another host creates at the same time as ADD
+	racingID        string
+	racingCreatedAt string
+
+	// whether another host deletes the network found by ADD before the
+	// port is created on it
+	deletedBeforePort bool
+
+	networkType    string
+	segmentationID string
+
+	legacy fakeLegacy
+}
+
+type fakeSubnets struct {
+	sync.Mutex
+	existing []string
+	requests [][]byte
+	created  []map[string]interface{}
+	deleted  int32
+
+	// whether another host creates the same subnet just before ADD
+	racing bool
+
+	// whether another host creates a port on the subnets just before they
+	// are deleted
+	inUse bool
+
+	hostRoutes string
+	dns        string
+}
+
+type fakePorts struct {
+	created     int32
+	live        int32
+	deleted     []string
+	failDeletes bool
+
+	// the last port created, and the network it was created on
+	request   []byte
+	networkID string
+	dualStack bool
+	status    string
+
+	// the ports listed by tags, the tags and device owners they were
+	// listed by, and the ports listed on a network
+	hostPorts    string
+	tags         string
+	deviceOwners []string
+	networkPorts string
+}
+
+type fakeRouters struct {
+	sync.Mutex
+	ids        []string
+	request    []byte
+	interfaces map[string]string
+	deleted    int32
+
+	legacy fakeLegacy
+}
+
+type fakeSecurityGroups struct {
+	sync.Mutex
+	ids      []string
+	names    map[string]string
+	clusters map[string]string
+	deleted  int32
+
+	// the rules listed, created and deleted
+	rules        string
+	ruleRequests []string
+	rulesDeleted []string
+
+	legacy fakeLegacy
+}
+
+// fakeLegacy tracks the resources created by releases that did not tag them
+// yet, and the tags they get once adopted.
+type fakeLegacy struct {
+	ids  []string
+	tags map[string][]string
+}
+
+// listed reports whether a resource matches a tag filter, and returns its
+// tags. Only legacy resources lack the tags of the filter.
+func (l *fakeLegacy) listed(id, filter string) (bool, []string) {
+	if contains(l.ids, id) {
+		return filter == "", []string{}
+	}
+	return true, []string{"gofer"}
+}
+
+func (l *fakeLegacy) replaceTags(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	id := filepath.Base(filepath.Dir(r.URL.Path))
+	l.ids = without(l.ids, id)
+	l.tags[id] = req.Tags
+	w.Write([]byte(`{}`))
+}
+
+func newFakeNeutron() *fakeNeutron {
+	f := &fakeNeutron{}
+	f.networks.createdAt = map[string]string{}
+	f.networks.networkType = "vxlan"
+	f.networks.segmentationID = "1001"
+	f.networks.legacy.tags = map[string][]string{}
+	f.subnets.hostRoutes = "[]"
+	f.subnets.dns = "[]"
+	f.ports.status = "ACTIVE"
+	f.ports.hostPorts = "[]"
+	f.ports.networkPorts = "[]"
+	f.routers.interfaces = map[string]string{}
+	f.routers.legacy.tags = map[string][]string{}
+	f.securityGroups.names = map[string]string{}
+	f.securityGroups.clusters = map[string]string{}
+	f.securityGroups.rules = "[]"
+	f.securityGroups.legacy.tags = map[string][]string{}
+
+	mux := http.NewServeMux()
+	for path, handler := range map[string]http.HandlerFunc{
+		"/v2.0/networks":             f.serveNetworks,
+		"/v2.0/subnets":              f.serveSubnets,
+		"/v2.0/ports":                f.servePorts,
+		"/v2.0/routers":              f.serveRouters,
+		"/v2.0/security-groups":      f.serveSecurityGroups,
+		"/v2.0/security-group-rules": f.serveSecurityGroupRules,
+	} {
+		mux.Handle(path, handler)
+		mux.Handle(path+"/", handler)
+	}
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.revokeTokenOn == r.Method+" "+r.URL.Path {
+			f.revokeTokenOn = ""
+			f.rejectedToken = r.Header.Get("X-Auth-Token")
+		}
+		if f.rejectedToken != "" && r.Header.Get("X-Auth-Token") == f.rejectedToken {
+			atomic.AddInt32(&f.rejected, 1)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(unauthorizedResp))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+func (f *fakeNeutron) serveNetworks(w http.ResponseWriter, r *http.Request) {
+	n := &f.networks
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2.0/networks/"):
+		atomic.AddInt32(&n.lookups, 1)
+		fmt.Fprintf(w, `{ "network": { "id": "%s", "provider:network_type": "%s", "provider:segmentation_id": %s } }`,
+			filepath.Base(r.URL.Path), n.networkType, n.segmentationID)
+
+	case r.Method == http.MethodGet:
+		n.Lock()
+		n.tags = r.URL.Query().Get("tags")
+		resp := []map[string]interface{}{}
+		for _, id := range n.ids {
+			if ok, tags := n.legacy.listed(id, n.tags); ok {
+				resp = append(resp, map[string]interface{}{"id": id, "name": "4246c57d-aefc-49cc-afe0-5f734e2656e8", "created_at": n.createdAt[id], "tags": tags})
+			}
+		}
+		n.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"networks": resp})
+
+	case r.Method == http.MethodPut:
+		n.Lock()
+		n.legacy.replaceTags(w, r)
+		n.Unlock()
+
+	case r.Method == http.MethodPost:
+		var req struct {
+			Network json.RawMessage `json:"network"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		id := fmt.Sprintf("cc6c1929-6b26-4a1a-8680-%012d", atomic.AddInt32(&n.created, 1))
+		n.Lock()
+		n.request = req.Network
+		n.ids = append(n.ids, id)
+		n.createdAt[id] = "2026-10-17T12:00:01Z"
+		if n.racingID != "" {
+			n.ids = append(n.ids, n.racingID)
+			n.createdAt[n.racingID] = n.racingCreatedAt
+		}
+		createdAt := n.createdAt[id]
+		n.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{ "network": { "id": "%s", "created_at": "%s" } }`, id, createdAt)
+
+	case r.Method == http.MethodDelete:
+		atomic.AddInt32(&n.deleted, 1)
+		n.Lock()
+		n.ids = without(n.ids, filepath.Base(r.URL.Path))
+		n.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeNeutron) serveSubnets(w http.ResponseWriter, r *http.Request) {
+	s := &f.subnets
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/83a8b5d3-1a6f-4e0e-9e27-4a1a0a4b7c6e"):
+		w.Write([]byte(subnet6Resp))
+
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2.0/subnets/"):
+		fmt.Fprintf(w, subnetResp, s.hostRoutes, s.dns)
+
+	case r.Method == http.MethodGet && r.URL.Query().Get("network_id") != "":
+		resp := []map[string]interface{}{}
+		s.Lock()
+		for _, subnet := range s.created {
+			if subnet["network_id"] == r.URL.Query().Get("network_id") {
+				resp = append(resp, subnet)
+			}
+		}
+		s.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"subnets": resp})
+
+	case r.Method == http.MethodGet:
+		resp := []map[string]interface{}{}
+		for _, cidr := range s.existing {
+			resp = append(resp, map[string]interface{}{"cidr": cidr})
+		}
+		s.Lock()
+		for _, subnet := range s.created {
+			if subnet["cidr"] != nil {
+				resp = append(resp, subnet)
+			}
+		}
+		s.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"subnets": resp})
+
+	case r.Method == http.MethodPost:
+		var req struct {
+			Subnet json.RawMessage `json:"subnet"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var subnet map[string]interface{}
+		json.Unmarshal(req.Subnet, &subnet)
+		subnet["id"] = "cc6c1929-6b26-4a1a-8680-3ea3dd09bfc6"
+		if subnet["ip_version"] == 6.0 {
+			subnet["id"] = "83a8b5d3-1a6f-4e0e-9e27-4a1a0a4b7c6e"
+		}
+		subnet["created_at"] = "2026-10-17T12:00:01Z"
+		s.Lock()
+		s.requests = append(s.requests, req.Subnet)
+		if s.racing && len(s.created) == 0 {
+			s.created = append(s.created, map[string]interface{}{
+				"id": "00000000-0000-0000-0000-0000000000a1", "cidr": subnet["cidr"], "created_at": "2026-10-17T12:00:00Z",
+			})
+		}
+		s.created = append(s.created, subnet)
+		s.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"subnet": subnet})
+
+	case r.Method == http.MethodDelete:
+		if s.inUse {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{ "NeutronError": { "type": "SubnetInUse", "message": "Unable to complete operation on subnet %s." } }`, filepath.Base(r.URL.Path))
+			return
+		}
+		atomic.AddInt32(&s.deleted, 1)
+		s.Lock()
+		for i, subnet := range s.created {
+			if subnet["id"] == filepath.Base(r.URL.Path) {
+				s.created = append(s.created[:i], s.created[i+1:]...)
+				break
+			}
+		}
+		s.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeNeutron) servePorts(w http.ResponseWriter, r *http.Request) {
+	p := &f.ports
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/v2.0/ports/"):
+		fmt.Fprintf(w, `{ "port": %s }`, strings.Replace(portJSON, `"ACTIVE"`, `"`+p.status+`"`, 1))
+
+	case r.Method == http.MethodGet && query.Get("device_owner") == "network:router_interface":
+		json.NewEncoder(w).Encode(map[string]interface{}{"ports": f.routers.interfacePorts(query.Get("device_id"))})
+
+	case r.Method == http.MethodGet && query.Get("tags") != "":
+		p.tags = query.Get("tags")
+		p.deviceOwners = query["device_owner"]
+		w.Write([]byte(`{ "ports": ` + p.hostPorts + ` }`))
+
+	case r.Method == http.MethodGet && query.Get("name") == "":
+		w.Write([]byte(`{ "ports": ` + p.networkPorts + ` }`))
+
+	case r.Method == http.MethodGet:
+		if atomic.LoadInt32(&p.live) > 0 && query.Get("name") == "some-container-id" {
+			w.Write([]byte(`{ "ports": [` + portJSON + `] }`))
+		} else {
+			w.Write([]byte(`{ "ports": [] }`))
+		}
+
+	case r.Method == http.MethodPost:
+		if f.networks.deletedBeforePort {
+			f.networks.deletedBeforePort = false
+			f.networks.Lock()
+			f.networks.ids = nil
+			f.networks.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{ "NeutronError": { "type": "NetworkNotFound", "message": "Network could not be found." } }`))
+			return
+		}
+
+		var req struct {
+			Port json.RawMessage `json:"port"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		p.request = req.Port
+		var port struct {
+			NetworkID string `json:"network_id"`
+		}
+		json.Unmarshal(req.Port, &port)
+		p.networkID = port.NetworkID
+		atomic.AddInt32(&p.created, 1)
+		atomic.AddInt32(&p.live, 1)
+
+		w.WriteHeader(http.StatusCreated)
+		if p.dualStack {
+			w.Write([]byte(`{ "port": ` + dualStackPortJSON + ` }`))
+		} else {
+			w.Write([]byte(`{ "port": ` + portJSON + ` }`))
+		}
+
+	case r.Method == http.MethodDelete:
+		if p.failDeletes {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, `{ "NeutronError": { "message": "Port %s could not be deleted" } }`, filepath.Base(r.URL.Path))
+			return
+		}
+		if contains(p.deleted, filepath.Base(r.URL.Path)) {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{ "NeutronError": { "type": "PortNotFound", "message": "Port %s could not be found." } }`, filepath.Base(r.URL.Path))
+			return
+		}
+		atomic.AddInt32(&p.live, -1)
+		p.deleted = append(p.deleted, filepath.Base(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeNeutron) serveRouters(w http.ResponseWriter, r *http.Request) {
+	rt := &f.routers
+	switch r.Method {
+	case http.MethodGet:
+		rt.Lock()
+		resp := []map[string]interface{}{}
+		for _, id := range rt.ids {
+			if ok, tags := rt.legacy.listed(id, r.URL.Query().Get("tags")); ok {
+				resp = append(resp, map[string]interface{}{"id": id, "name": "2ac41bbf-8eae-4f28-abab-51ca38dea3e4", "tags": tags})
+			}
+		}
+		rt.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"routers": resp})
+
+	case http.MethodPost:
+		var req struct {
+			Router json.RawMessage `json:"router"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		rt.Lock()
+		rt.request = req.Router
+		id := fmt.Sprintf("router-%d", len(rt.ids)+1)
+		rt.ids = append(rt.ids, id)
+		rt.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{ "router": { "id": "%s" } }`, id)
+
+	case http.MethodPut:
+		if strings.HasSuffix(r.URL.Path, "/tags") {
+			rt.Lock()
+			rt.legacy.replaceTags(w, r)
+			rt.Unlock()
+			return
+		}
+
+		var req struct {
+			SubnetID string `json:"subnet_id"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		parts := strings.Split(r.URL.Path, "/")
+		routerID := parts[len(parts)-2]
+
+		rt.Lock()
+		if strings.HasSuffix(r.URL.Path, "/add_router_interface") {
+			rt.interfaces[req.SubnetID] = routerID
+		} else {
+			delete(rt.interfaces, req.SubnetID)
+		}
+		rt.Unlock()
+		w.Write([]byte(`{}`))
+
+	case http.MethodDelete:
+		id := filepath.Base(r.URL.Path)
+		rt.Lock()
+		found := contains(rt.ids, id)
+		rt.ids = without(rt.ids, id)
+		rt.Unlock()
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&rt.deleted, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// interfacePorts returns the router interface ports of a router, or of all
+// routers when routerID is empty.
+func (rt *fakeRouters) interfacePorts(routerID string) []map[string]interface{} {
+	rt.Lock()
+	defer rt.Unlock()
+	ports := []map[string]interface{}{}
+	for subnetID, id := range rt.interfaces {
+		if routerID == "" || routerID == id {
+			ports = append(ports, map[string]interface{}{
+				"id":        "port-" + subnetID,
+				"device_id": id,
+				"fixed_ips": []map[string]string{{"subnet_id": subnetID}},
+			})
+		}
+	}
+	return ports
+}
+
+func (f *fakeNeutron) serveSecurityGroups(w http.ResponseWriter, r *http.Request) {
+	sg := &f.securityGroups
+	switch r.Method {
+	case http.MethodGet:
+		query := r.URL.Query()
+		sg.Lock()
+		resp := []map[string]interface{}{}
+		for _, id := range sg.ids {
+			name, ok := sg.names[id]
+			if !ok {
+				name = "d5bbc5ed-886a-44e6-945d-67df1013fa16"
+			}
+			inCluster := true
+			for _, tag := range strings.Split(query.Get("tags"), ",") {
+				if strings.HasPrefix(tag, "cluster_id:") {
+					inCluster = tag == "cluster_id:"+sg.clusters[id]
+				}
+			}
+			listed, tags := sg.legacy.listed(id, query.Get("tags"))
+			if (query.Get("name") == "" || name == query.Get("name")) && inCluster && listed {
+				resp = append(resp, map[string]interface{}{"id": id, "name": name, "tags": tags})
+			}
+		}
+		sg.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"security_groups": resp})
+
+	case http.MethodPost:
+		var req struct {
+			SecurityGroup struct {
+				Name string   `json:"name"`
+				Tags []string `json:"tags"`
+			} `json:"security_group"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		sg.Lock()
+		id := fmt.Sprintf("secgroup-%d", len(sg.ids)+1)
+		sg.ids = append(sg.ids, id)
+		sg.names[id] = req.SecurityGroup.Name
+		for _, tag := range req.SecurityGroup.Tags {
+			if strings.HasPrefix(tag, "cluster_id:") {
+				sg.clusters[id] = strings.TrimPrefix(tag, "cluster_id:")
+			}
+		}
+		sg.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{ "security_group": { "id": "%s" } }`, id)
+
+	case http.MethodPut:
+		sg.Lock()
+		sg.legacy.replaceTags(w, r)
+		sg.Unlock()
+
+	case http.MethodDelete:
+		atomic.AddInt32(&sg.deleted, 1)
+		sg.Lock()
+		sg.ids = without(sg.ids, filepath.Base(r.URL.Path))
+		sg.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeNeutron) serveSecurityGroupRules(w http.ResponseWriter, r *http.Request) {
+	sg := &f.securityGroups
+	switch r.Method {
+	case http.MethodGet:
+		var rules []map[string]interface{}
+		json.Unmarshal([]byte(sg.rules), &rules)
+		groupIDs := r.URL.Query()["security_group_id"]
+		resp := []map[string]interface{}{}
+		for _, rule := range rules {
+			matches := len(groupIDs) == 0
+			for _, id := range groupIDs {
+				matches = matches || id == rule["security_group_id"]
+			}
+			if matches {
+				resp = append(resp, rule)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"security_group_rules": resp})
+
+	case http.MethodPost:
+		var req struct {
+			Rule json.RawMessage `json:"security_group_rule"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		sg.Lock()
+		sg.ruleRequests = append(sg.ruleRequests, string(req.Rule))
+		sg.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{ "security_group_rule": {} }`))
+
+	case http.MethodDelete:
+		sg.Lock()
+		sg.rulesDeleted = append(sg.rulesDeleted, filepath.Base(r.URL.Path))
+		sg.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func without(ids []string, id string) []string {
+	for i, existing := range ids {
+		if existing == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
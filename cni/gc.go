@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultGCGracePeriod = 10 * time.Minute
+
+// runGC implements `gofer gc`, which removes the Neutron ports and state
+// files of containers that no longer exist, e.g. after a cell crashed or a
+// DEL failed. Live container IDs are read one per line from stdin with
+// -stdin, or from a garden-compatible server with -garden-url. An empty list
+// of live containers would collect every container of this host, so it is
+// refused unless -allow-empty is given.
+func runGC(args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	configPath := flags.String("config", "", "CNI net config with the neutron and keystone settings")
+	fromStdin := flags.Bool("stdin", false, "read the live container IDs from stdin, one per line")
+	gardenURL := flags.String("garden-url", "", "garden server to list live containers from")
+	allowEmpty := flags.Bool("allow-empty", false, "collect every container of this host when none are live")
+	grace := flags.Duration("grace-period", defaultGCGracePeriod, "minimum age of ports and state files before they are collected")
+	dryRun := flags.Bool("dry-run", false, "print the orphans without removing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath == "" {
+		return errors.New("gc requires -config")
+	}
+	if *fromStdin == (*gardenURL != "") {
+		return errors.New("gc requires one of -stdin or -garden-url")
+	}
+	n, err := loadNetConfigFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	var live map[string]bool
+	if *gardenURL != "" {
+		live, err = gardenContainers(*gardenURL)
+	} else {
+		live, err = readContainerIDs(os.Stdin)
+	}
+	if err != nil {
+		return fmt.Errorf("error listing live containers: %w", err)
+	}
+	if len(live) == 0 && !*allowEmpty {
+		return errors.New("no live containers listed, pass -allow-empty to collect every container of this host")
+	}
+
+	err = withNeutron(n, func(client *neutronClient) error {
+		return collectGarbage(client, n, live, time.Now().Add(-*grace), *dryRun, os.Stdout)
+	})
+	return redactSecrets(err, n)
+}
+
+func readContainerIDs(r io.Reader) (map[string]bool, error) {
+	live := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			live[id] = true
+		}
+	}
+	return live, scanner.Err()
+}
+
+// gardenContainers lists the handles of the containers on a garden server,
+// which garden-external-networker passes to CNI as container IDs.
+func gardenContainers(gardenURL string) (map[string]bool, error) {
+	resp, err := httpClient.Get(strings.TrimSuffix(gardenURL, "/") + "/containers")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("garden returned %s: %s", resp.Status, msg)
+	}
+
+	var list struct {
+		Handles []string `json:"Handles"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	live := map[string]bool{}
+	for _, handle := range list.Handles {
+		live[handle] = true
+	}
+	return live, nil
+}
+
+// collectGarbage deletes the ports of this host and the state files of
+// containers that are not live. Anything created after cutoff is left alone,
+// as its container may still be in the middle of an ADD, and so are files
+// that are not container state.
+func collectGarbage(client *neutronClient, n *NetConf, live map[string]bool, cutoff time.Time, dryRun bool, out io.Writer) error {
+	states, err := ioutil.ReadDir(n.StateDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var errs []string
+	for _, state := range states {
+		// lock and cache files are dotfiles
+		id := state.Name()
+		if state.IsDir() || strings.HasPrefix(id, ".") || live[id] || state.ModTime().After(cutoff) {
+			continue
+		}
+
+		// the state dir may hold files of operators or other tools
+		if cs, err := loadContainerState(id, n.StateDir); err != nil || cs.NeutronPortID == "" {
+			fmt.Fprintf(out, "? %s is not container state, skipping\n", id)
+			continue
+		}
+
+		fmt.Fprintf(out, "- state %s\n", id)
+		if dryRun {
+			continue
+		}
+		if err := removeContainerState(id, n.StateDir); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	q := url.Values{}
+	for _, owner := range deviceOwners {
+		q.Add("device_owner", owner)
+	}
+	ports, err := client.PortSummaries(withTags(q, append(ownerTags(n), hostTag(n))))
+	if err != nil {
+		return fmt.Errorf("error listing neutron ports: %w", err)
+	}
+
+	for _, p := range ports {
+		if live[p.DeviceID] || !createdBefore(p.CreatedAt, cutoff) {
+			continue
+		}
+
+		fmt.Fprintf(out, "- port %s of container %s\n", p.ID, p.DeviceID)
+		if dryRun {
+			continue
+		}
+		if err := client.DeletePort(p.ID); err != nil {
+			errs = append(errs, fmt.Sprintf("error deleting port %s: %v", p.ID, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// createdBefore reports whether a Neutron timestamp is before cutoff. Ports
+// without a creation time are treated as new.
+func createdBefore(createdAt string, cutoff time.Time) bool {
+	t, err := time.Parse(time.RFC3339, createdAt)
+	return err == nil && t.Before(cutoff)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const defaultDomain = "Default"
+
+// Keystone returns the token it issues in this header
+const subjectTokenHeader = "X-Subject-Token"
+
+// Keystone auth methods selectable with 'keystone_auth_type'
+const (
+	authTypePassword              = "password"
+	authTypeApplicationCredential = "application_credential"
+	authTypeTrust                 = "trust"
+)
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// Keystone v3 auth request, see
+// https://developer.openstack.org/api-ref/identity/v3/#authentication-and-token-management
+type authRequest struct {
+	Auth authBody `json:"auth"`
+}
+
+type authBody struct {
+	Identity authIdentity `json:"identity"`
+	Scope    *authScope   `json:"scope,omitempty"`
+}
+
+type authIdentity struct {
+	Methods               []string                   `json:"methods"`
+	Password              *authPassword              `json:"password,omitempty"`
+	ApplicationCredential *authApplicationCredential `json:"application_credential,omitempty"`
+}
+
+type authPassword struct {
+	User authUser `json:"user"`
+}
+
+type authUser struct {
+	Name     string     `json:"name"`
+	Domain   authDomain `json:"domain"`
+	Password string     `json:"password"`
+}
+
+type authApplicationCredential struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type authDomain struct {
+	Name string `json:"name"`
+}
+
+type authScope struct {
+	Project *authProject `json:"project,omitempty"`
+	Trust   *authTrust   `json:"OS-TRUST:trust,omitempty"`
+}
+
+type authTrust struct {
+	ID string `json:"id"`
+}
+
+type authProject struct {
+	ID     string      `json:"id,omitempty"`
+	Name   string      `json:"name,omitempty"`
+	Domain *authDomain `json:"domain,omitempty"`
+}
+
+type tokenResponse struct {
+	Token struct {
+		ExpiresAt time.Time `json:"expires_at"`
+		Project   *struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"project"`
+	} `json:"token"`
+}
+
+func newAuthRequest(n *NetConf) authRequest {
+	if n.KeystoneAuthType == authTypeApplicationCredential {
+		// application credentials are bound to a project and may not be scoped
+		return authRequest{
+			Auth: authBody{
+				Identity: authIdentity{
+					Methods: []string{authTypeApplicationCredential},
+					ApplicationCredential: &authApplicationCredential{
+						ID:     n.KeystoneApplicationCredentialID,
+						Secret: n.KeystoneApplicationCredentialSecret,
+					},
+				},
+			},
+		}
+	}
+
+	req := authRequest{
+		Auth: authBody{
+			Identity: authIdentity{
+				Methods: []string{authTypePassword},
+				Password: &authPassword{
+					User: authUser{
+						Name:     n.KeystoneUsername,
+						Domain:   authDomain{Name: n.KeystoneUserDomain},
+						Password: n.KeystonePassword,
+					},
+				},
+			},
+		},
+	}
+
+	switch {
+	case n.KeystoneAuthType == authTypeTrust:
+		// the trustee authenticates and is scoped to the trust
+		req.Auth.Scope = &authScope{
+			Trust: &authTrust{ID: n.KeystoneTrustID},
+		}
+	case n.KeystoneProjectID != "":
+		req.Auth.Scope = &authScope{
+			Project: &authProject{ID: n.KeystoneProjectID},
+		}
+	case n.KeystoneProject != "":
+		req.Auth.Scope = &authScope{
+			Project: &authProject{
+				Name:   n.KeystoneProject,
+				Domain: &authDomain{Name: n.KeystoneProjectDomain},
+			},
+		}
+	}
+	return req
+}
+
+// scopeName describes the requested token scope for error messages.
+func scopeName(n *NetConf) string {
+	switch {
+	case n.KeystoneAuthType == authTypeTrust:
+		return fmt.Sprintf("trust %q", n.KeystoneTrustID)
+	case n.KeystoneProjectID != "":
+		return fmt.Sprintf("project id %q", n.KeystoneProjectID)
+	default:
+		return fmt.Sprintf("project %q in domain %q", n.KeystoneProject, n.KeystoneProjectDomain)
+	}
+}
+
+func tokensURL(keystoneURL string) string {
+	u := strings.TrimSuffix(keystoneURL, "/")
+	u = strings.TrimSuffix(u, "/v3")
+	return u + "/v3/auth/tokens"
+}
+
+// requestToken issues a Keystone v3 token using the configured auth method,
+// scoped to a project or trust when one is configured, and returns it along
+// with its expiry.
+func requestToken(n *NetConf) (string, time.Time, error) {
+	req := newAuthRequest(n)
+	scoped := req.Auth.Scope != nil && req.Auth.Scope.Project != nil
+	trust := req.Auth.Scope != nil && req.Auth.Scope.Trust != nil
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	resp, err := httpClient.Post(tokensURL(n.KeystoneURL), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("error calling keystone: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		if (scoped || trust) && resp.StatusCode == http.StatusUnauthorized {
+			return "", time.Time{}, fmt.Errorf("keystone rejected token scope %s: %s", scopeName(n), msg)
+		}
+		return "", time.Time{}, fmt.Errorf("error calling keystone: %s: %s", resp.Status, msg)
+	}
+
+	token := resp.Header.Get(subjectTokenHeader)
+	if token == "" {
+		return "", time.Time{}, errors.New("keystone response is missing a token")
+	}
+
+	expiresAt := time.Now().Add(defaultTokenLifetime)
+
+	var tr tokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	switch {
+	case err == io.EOF:
+		// no token body, assume the default lifetime
+	case err != nil:
+		return "", time.Time{}, fmt.Errorf("failed to parse keystone token: %w", err)
+	default:
+		if scoped && tr.Token.Project == nil {
+			return "", time.Time{}, fmt.Errorf("keystone issued an unscoped token for %s", scopeName(n))
+		}
+		if !tr.Token.ExpiresAt.IsZero() {
+			expiresAt = tr.Token.ExpiresAt
+		}
+	}
+	return token, expiresAt, nil
+}
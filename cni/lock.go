@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"syscall"
+)
+
+var unsafeLockChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// lockPath is the host-wide lock serializing changes to a named resource of
+// the given kind, like the network of a space.
+func lockPath(stateDir, kind, name string) string {
+	return filepath.Join(stateDir, "."+kind+"-"+unsafeLockChars.ReplaceAllString(name, "_")+".lock")
+}
+
+// fileLock is an exclusive, host-wide advisory lock backed by flock(2).
+// It serializes gofer plugin processes that share a state_dir.
+type fileLock struct {
+	f *os.File
+}
+
+func lockFile(path string) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock dir: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %q: %w", path, err)
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %q: %w", path, err)
+	}
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) Unlock() error {
+	defer l.f.Close()
+	return syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN)
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 
 	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
-	"github.com/markstgodard/go-keystone/keystone"
 	"github.com/markstgodard/go-neutron/neutron"
 )
 
@@ -25,17 +27,28 @@ import (
 // the virtual network interface.
 // IP address created from Neutron create port will be passed to delegate CNI
 // plugin via a runtime updated `delegate` which adds the `ip` and `cidr` property.
-// (i.e. "ip: "10.0.1.10", "cidr": "10.0.1.10/32" )
+// (i.e. "ip: "10.0.1.10", "cidr": "10.0.1.10/32" ), along with the subnet,
+// segment and port of the address.
+// Run with a command as its first argument, it serves operators instead; see
+// commands.
 // Example CNI Plugin config:
 /*
 {
-	"cniVersion": "0.2.0",
+	"cniVersion": "1.0.0",
   "name": "cni-neutron-ovs",
   "type": "gofer",
 	"neutron_url": "https://somehost:9696",
 	"keystone_url": "https://somehost:5000",
-	"keystone_user": "admin",
+	"keystone_username": "admin",
 	"keystone_password": "some-password",
+	"keystone_user_domain": "Default",
+	"keystone_project": "cf",
+	"keystone_project_domain": "Default",
+	"supernet": "10.64.0.0/12",
+	"subnet_prefix_len": 24,
+	"cluster_id": "cf-prod",
+	"delete_empty_networks": true,
+	"disable_port_security": false,
 	"delegate": {
     "name": "cni-ovs",
     "type": "ovs",
@@ -65,11 +78,61 @@ type NetConf struct {
 	StateDir         string                 `json:"state_dir"`
 	Delegate         map[string]interface{} `json:"delegate"`
 	Metadata         map[string]interface{} `json:"metadata"`
+
+	// Keystone domain of the user and the project to scope tokens to
+	KeystoneUserDomain    string `json:"keystone_user_domain"`
+	KeystoneProject       string `json:"keystone_project"`
+	KeystoneProjectID     string `json:"keystone_project_id"`
+	KeystoneProjectDomain string `json:"keystone_project_domain"`
+
+	// Keystone auth method: "password" (default), "application_credential"
+	// or "trust"
+	KeystoneAuthType                    string `json:"keystone_auth_type"`
+	KeystoneApplicationCredentialID     string `json:"keystone_application_credential_id"`
+	KeystoneApplicationCredentialSecret string `json:"keystone_application_credential_secret"`
+	KeystoneTrustID                     string `json:"keystone_trust_id"`
+
+	// root-only file with Keystone settings left out of this config, and the
+	// cloud to use if it is a clouds.yaml with several
+	CredentialsFile string `json:"credentials_file"`
+	Cloud           string `json:"cloud"`
+
+	// subnets of new space networks are carved out of the supernet or
+	// allocated from a Neutron subnet pool, defaults to 10.0.3.0/24
+	Supernet        string `json:"supernet"`
+	SubnetPoolID    string `json:"subnetpool_id"`
+	SubnetPrefixLen int    `json:"subnet_prefix_len"`
+
+	// optional IPv6 subnet next to the IPv4 one, "slaac" or "dhcpv6-stateful"
+	IPv6Mode         string `json:"ipv6_mode"`
+	IPv6Supernet     string `json:"ipv6_supernet"`
+	IPv6SubnetPoolID string `json:"ipv6_subnetpool_id"`
+
+	// tags the resources of this cluster, so several clusters can share a
+	// Neutron project
+	ClusterID string `json:"cluster_id"`
+
+	// name of this host in Neutron, defaults to the hostname
+	HostID string `json:"host_id"`
+
+	// delete space networks once their last container is gone
+	DeleteEmptyNetworks bool `json:"delete_empty_networks"`
+
+	// connect space subnets to a router per org, with an optional external
+	// gateway network
+	ManageRouters     bool   `json:"manage_routers"`
+	ExternalNetworkID string `json:"external_network_id"`
+
+	// container ports get a security group per Cloud Foundry policy group
+	// unless port security is disabled
+	DisablePortSecurity bool `json:"disable_port_security"`
 }
 
 type ContainerState struct {
 	IP            string `json:"ip"`
+	IP6           string `json:"ip6,omitempty"`
 	NeutronPortID string `json:"neutron_port_id"`
+	NetworkID     string `json:"network_id,omitempty"`
 }
 
 func loadNetConfig(stdin []byte) (*NetConf, error) {
@@ -77,47 +140,159 @@ func loadNetConfig(stdin []byte) (*NetConf, error) {
 		StateDir: defaultStateDir,
 	}
 	if err := json.Unmarshal(stdin, n); err != nil {
-		return nil, fmt.Errorf("failed to load netconf: %v", err)
+		return nil, fmt.Errorf("failed to load netconf: %w", err)
 	}
 
 	if n.NeutronURL == "" {
 		return nil, errors.New("missing 'neutronURL' in CNI net config")
 	}
 
+	if err := loadCredentials(n); err != nil {
+		return nil, redactSecrets(err, n)
+	}
+
+	if n.KeystoneURL == "" {
+		return nil, errors.New("missing 'keystone_url' in CNI net config, credentials file, OS_CLOUD or OS_AUTH_URL")
+	}
+
 	if len(n.Delegate) == 0 {
 		return nil, errors.New("missing 'delegate' in CNI net config")
 	}
+
+	if n.KeystoneProject != "" && n.KeystoneProjectID != "" {
+		return nil, errors.New("only one of 'keystone_project' and 'keystone_project_id' may be set in CNI net config")
+	}
+
+	if err := validateAuthType(n); err != nil {
+		return nil, err
+	}
+
+	if err := validateSubnetConfig(n); err != nil {
+		return nil, err
+	}
+
+	if err := validateClusterID(n); err != nil {
+		return nil, err
+	}
+
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return nil, err
+	}
+
+	// the delegate speaks gofer's CNI version and sees the same prevResult
+	n.Delegate["cniVersion"] = n.CNIVersion
+	if _, ok := n.Delegate["name"]; !ok {
+		n.Delegate["name"] = n.Name
+	}
+	if n.RawPrevResult != nil {
+		n.Delegate["prevResult"] = n.RawPrevResult
+	}
+
+	if n.HostID == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		n.HostID = host
+	}
+
+	if n.KeystoneUserDomain == "" {
+		n.KeystoneUserDomain = defaultDomain
+	}
+	if n.KeystoneProjectDomain == "" {
+		n.KeystoneProjectDomain = n.KeystoneUserDomain
+	}
 	return n, nil
 }
 
-func delegateAdd(id string, netconf map[string]interface{}) error {
+// loadNetConfigFile loads the CNI net config for gofer's commands.
+func loadNetConfigFile(path string) (*NetConf, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return loadNetConfig(conf)
+}
+
+func validateAuthType(n *NetConf) error {
+	projectScoped := n.KeystoneProject != "" || n.KeystoneProjectID != ""
+
+	switch n.KeystoneAuthType {
+	case "":
+		n.KeystoneAuthType = authTypePassword
+	case authTypePassword:
+	case authTypeApplicationCredential:
+		if n.KeystoneApplicationCredentialID == "" || n.KeystoneApplicationCredentialSecret == "" {
+			return errors.New("missing 'keystone_application_credential_id' or 'keystone_application_credential_secret' in CNI net config")
+		}
+		if projectScoped {
+			return errors.New("application credentials can not be scoped to a 'keystone_project' in CNI net config")
+		}
+	case authTypeTrust:
+		if n.KeystoneTrustID == "" {
+			return errors.New("missing 'keystone_trust_id' in CNI net config")
+		}
+		if projectScoped {
+			return errors.New("trust tokens can not be scoped to a 'keystone_project' in CNI net config")
+		}
+	default:
+		return fmt.Errorf("invalid 'keystone_auth_type' %q in CNI net config", n.KeystoneAuthType)
+	}
+	return nil
+}
+
+func delegateAdd(id string, netconf map[string]interface{}) (types.Result, error) {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
-		return fmt.Errorf("error marshalling delegate netconf: %v", err)
+		return nil, fmt.Errorf("error marshalling delegate netconf: %w", err)
 	}
 
-	result, err := invoke.DelegateAdd(netconf["type"].(string), netconfBytes)
+	result, err := invoke.DelegateAdd(context.TODO(), netconf["type"].(string), netconfBytes, nil)
 	if err != nil {
-		return fmt.Errorf("error invoking delegate: %v", err)
+		return nil, fmt.Errorf("error invoking delegate: %w", err)
 	}
 
-	return result.Print()
+	return result, nil
 }
 
 func delegateDel(id string, netconf map[string]interface{}) error {
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
-		return fmt.Errorf("error marshalling delegate netconf: %v", err)
+		return fmt.Errorf("error marshalling delegate netconf: %w", err)
 	}
 
-	err = invoke.DelegateDel(netconf["type"].(string), netconfBytes)
+	err = invoke.DelegateDel(context.TODO(), netconf["type"].(string), netconfBytes, nil)
 	if err != nil {
-		return fmt.Errorf("error invoking delegate: %v", err)
+		return fmt.Errorf("error invoking delegate: %w", err)
 	}
 
 	return nil
 }
 
+func delegateCheck(id string, netconf map[string]interface{}) error {
+	netconfBytes, err := json.Marshal(netconf)
+	if err != nil {
+		return fmt.Errorf("error marshalling delegate netconf: %w", err)
+	}
+
+	err = invoke.DelegateCheck(context.TODO(), netconf["type"].(string), netconfBytes, nil)
+	if err != nil {
+		return fmt.Errorf("error invoking delegate: %w", err)
+	}
+
+	return nil
+}
+
+// networkName is the name of the network of the container's space.
+func networkName(n *NetConf) string {
+	name, err := getMetadata("space_id", n.Metadata)
+	if err != nil {
+		// TODO: temp hack to get around staging containers
+		return "defaultNetwork"
+	}
+	return name
+}
+
 func getMetadata(key string, metadata map[string]interface{}) (string, error) {
 	v, ok := metadata[key]
 	if !ok {
@@ -138,112 +313,252 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	networkName, err := getMetadata("space_id", n.Metadata)
-	if err != nil {
-		// TODO: temp hack to get around staging containers
-		networkName = "defaultNetwork"
+	err = withNeutron(n, func(client *neutronClient) error {
+		return add(args, n, client)
+	})
+	return redactSecrets(err, n)
+}
+
+// maxNetworkAttempts bounds how often ADD looks up the network again after
+// it was deleted before the port could be created on it.
+const maxNetworkAttempts = 3
+
+func add(args *skel.CmdArgs, n *NetConf, client *neutronClient) (err error) {
+	// undo everything created so far if any step fails
+	rb := &rollback{}
+	defer func() {
+		if err != nil {
+			err = rb.run(err)
+		}
+	}()
+
+	// a DEL of the last container of the space, on this or another host, may
+	// delete the network before the port is created on it, so find or create
+	// the network again when it is gone
+	var network networkDetail
+	var p portDetail
+	for attempt := 1; ; attempt++ {
+		network, err = ensureNetwork(client, n, networkName(n), rb)
+		if err != nil {
+			return err
+		}
+
+		p, err = ensurePort(client, args, n, network.ID, rb)
+		if err == nil {
+			break
+		}
+		if !isNotFound(err) || attempt == maxNetworkAttempts {
+			return err
+		}
 	}
 
-	keystoneClient, err := keystone.NewClient(n.KeystoneURL)
-	if err != nil {
-		return err
+	networkID := network.ID
+
+	// the Neutron OVS agent wires up the port by itself
+	if !neutronAgentDelegate(n) {
+		if err := setDelegateSegment(client, n, networkID); err != nil {
+			return err
+		}
 	}
 
-	// get token for username, password and domain name
-	// TODO: inject domain name as well?
-	auth := keystone.NewAuth(n.KeystoneUsername, n.KeystonePassword, "Default")
-	authToken, err := keystoneClient.Tokens(auth)
+	setDelegatePort(n, p)
+
+	cidr, cidr6, err := setDelegateAddresses(client, n, p.Port)
 	if err != nil {
 		return err
 	}
 
-	client, err := neutron.NewClient(n.NeutronURL, authToken)
+	result, err := delegateAdd(args.ContainerID, n.Delegate)
 	if err != nil {
-		return err
+		return fmt.Errorf("error calling delegate : %w", err)
 	}
+	rb.add("delegate DEL", func() error {
+		return delegateDel(args.ContainerID, n.Delegate)
+	})
 
-	networks, err := client.NetworksByName(networkName)
+	// save container state (container id, ip, neutron port id)
+	cs := ContainerState{
+		IP:            cidr,
+		IP6:           cidr6,
+		NeutronPortID: p.ID,
+		NetworkID:     networkID,
+	}
+	err = saveContainerState(args.ContainerID, cs, n.StateDir)
 	if err != nil {
 		return err
 	}
+	rb.add("remove container state", func() error {
+		return removeContainerState(args.ContainerID, n.StateDir)
+	})
 
-	var network neutron.Network
-
-	// if not found try to create net/subnet
-	if len(networks) == 0 {
-		// create network
-		net := neutron.Network{
-			Name:         networkName,
-			Description:  networkName,
-			AdminStateUp: true,
-		}
-		network, err = client.CreateNetwork(net)
-		if err != nil {
-			return err
-		}
-
-		// create subnet
-		subnet := neutron.Subnet{
-			NetworkID: network.ID,
-			IPVersion: 4,
-			CIDR:      defaultCIDR,
-			AllocationPools: []neutron.AllocationPool{
-				{
-					Start: defaultNetStart,
-					End:   defaultNetEnd,
-				},
-			},
-		}
+	return types.PrintResult(result, n.CNIVersion)
+}
 
-		_, err = client.CreateSubnet(subnet)
-		if err != nil {
-			return err
-		}
-	} else {
-		network = networks[0]
+// ensurePort reuses the port from a previous ADD for this container (i.e.
+// retries) or creates one on the network.
+func ensurePort(client *neutronClient, args *skel.CmdArgs, n *NetConf, networkID string, rb *rollback) (portDetail, error) {
+	p, found, err := existingPort(client, args.ContainerID, networkID, n.StateDir)
+	if err != nil {
+		return portDetail{}, fmt.Errorf("error looking up neutron port: %w", err)
+	}
+	if found {
+		return p, nil
 	}
 
-	networkID := network.ID
+	securityGroups, portSecurityEnabled, err := portSecurity(client, n, rb)
+	if err != nil {
+		return portDetail{}, err
+	}
 
 	// create neutron port
-	port := neutron.Port{
-		NetworkID:    networkID,
-		Name:         args.ContainerID,
-		AdminStateUp: true,
+	port := portRequest{
+		NetworkID:           networkID,
+		Name:                args.ContainerID,
+		AdminStateUp:        true,
+		DeviceOwner:         deviceOwner,
+		DeviceID:            args.ContainerID,
+		SecurityGroups:      securityGroups,
+		PortSecurityEnabled: portSecurityEnabled,
+		Tags:                append(resourceTags(n, metadataKeys...), hostTag(n)),
+	}
+	// binding the port hands it to the Neutron OVS agent of this host, and
+	// binding:host_id is admin-only by default, so only bind ports the agent
+	// wires up
+	if neutronAgentDelegate(n) {
+		port.HostID = n.HostID
+		port.DeviceOwner = agentDeviceOwner
+	}
+
+	p, err = client.CreatePort(port)
+	if err != nil {
+		return portDetail{}, fmt.Errorf("error calling neutron create port: %w", err)
 	}
+	portID := p.ID
+	rb.add("delete port "+portID, func() error {
+		return client.DeletePort(portID)
+	})
+	return p, nil
+}
 
-	p, err := client.CreatePort(port)
+// neutronAgentDelegate reports whether the delegate is the ovs plugin in
+// "neutron_agent" mode, which leaves the port to the Neutron OVS agent.
+func neutronAgentDelegate(n *NetConf) bool {
+	mode, _ := n.Delegate["mode"].(string)
+	return mode == "neutron_agent"
+}
+
+// setDelegateSegment passes the network type and segmentation ID of a space
+// network to the delegate CNI plugin, which uses the segmentation ID (the VNI
+// of VXLAN and Geneve networks) as tunnel ID. Neutron only shows them to
+// admins by default. When the neutron user cannot read them they are left
+// out, and only delegates that program tunnels, like the ovs plugin in flows
+// mode, fail the ADD.
+func setDelegateSegment(client *neutronClient, n *NetConf, networkID string) error {
+	network, err := client.Network(networkID)
 	if err != nil {
-		return fmt.Errorf("error calling neutron create port: %v", err)
+		return fmt.Errorf("error looking up neutron network %s: %w", networkID, err)
+	}
+	if network.NetworkType == "" || network.SegmentationID == nil {
+		return nil
 	}
 
-	if len(p.FixedIPs) != 1 {
-		return fmt.Errorf("error neutron create port failed to allocate ip address")
+	n.Delegate["network_type"] = network.NetworkType
+	n.Delegate["segmentation_id"] = *network.SegmentationID
+	return nil
+}
+
+// setDelegatePort passes the ID and MAC address of a port to the delegate CNI
+// plugin, which the Neutron OVS agent identifies the port of an interface by.
+func setDelegatePort(n *NetConf, p portDetail) {
+	n.Delegate["port_id"] = p.ID
+	n.Delegate["mac_address"] = p.MACAddress
+}
+
+// setDelegateAddresses passes the addresses of a port and their subnets to
+// the delegate CNI plugin, returning the addresses as host routes.
+func setDelegateAddresses(client *neutronClient, n *NetConf, p neutron.Port) (string, string, error) {
+	fixedIP, fixedIP6, err := portIPs(p)
+	if err != nil {
+		return "", "", err
 	}
 
-	// pass ip_addr to delegate CNI plugin
-	ip := p.FixedIPs[0].IPAddress
+	// pass ip_addr and its subnet to delegate CNI plugin
+	ip := fixedIP.IP
 	cidr := fmt.Sprintf("%s/32", ip)
 	n.Delegate["ip"] = ip
 	n.Delegate["cidr"] = cidr
 
-	err = delegateAdd(args.ContainerID, n.Delegate)
+	subnet, err := lookupDelegateSubnet(client, fixedIP.SubnetID)
 	if err != nil {
-		// attempt to cleanup / delete port, but preserve original err
-		client.DeletePort(port.ID)
-		return fmt.Errorf("error calling delegate : %v", err)
+		return "", "", err
 	}
+	n.Delegate["subnet"] = subnet
 
-	// save container state (container id, ip, neutron port id)
-	cs := ContainerState{
-		IP:            cidr,
-		NeutronPortID: p.ID,
+	var cidr6 string
+	if fixedIP6 != nil {
+		ip6 := fixedIP6.IP
+		cidr6 = fmt.Sprintf("%s/128", ip6)
+		n.Delegate["ip6"] = ip6
+		n.Delegate["cidr6"] = cidr6
+
+		subnet6, err := lookupDelegateSubnet(client, fixedIP6.SubnetID)
+		if err != nil {
+			return "", "", err
+		}
+		n.Delegate["subnet6"] = subnet6
 	}
-	err = saveContainerState(args.ContainerID, cs, n.StateDir)
-	if err != nil {
-		return err
+	return cidr, cidr6, nil
+}
+
+// portAddress is an IP address allocated to a port and its subnet.
+type portAddress struct {
+	IP       string
+	SubnetID string
+}
+
+// portIPs returns the IPv4 and, on dual-stack networks, IPv6 address
+// allocated to a port.
+func portIPs(p neutron.Port) (portAddress, *portAddress, error) {
+	var ip4, ip6 []portAddress
+	for _, fixedIP := range p.FixedIPs {
+		addr := portAddress{IP: fixedIP.IPAddress, SubnetID: fixedIP.SubnetID}
+		ip := net.ParseIP(addr.IP)
+		switch {
+		case ip == nil:
+			return portAddress{}, nil, fmt.Errorf("error neutron port has invalid ip address %q", addr.IP)
+		case ip.To4() != nil:
+			ip4 = append(ip4, addr)
+		default:
+			ip6 = append(ip6, addr)
+		}
 	}
-	return err
+
+	if len(ip4) != 1 || len(ip6) > 1 {
+		return portAddress{}, nil, fmt.Errorf("error neutron create port failed to allocate ip address")
+	}
+
+	if len(ip6) == 0 {
+		return ip4[0], nil, nil
+	}
+	return ip4[0], &ip6[0], nil
+}
+
+// existingPort finds a port already created for the container, preferring
+// the one recorded in its state file.
+func existingPort(client *neutronClient, containerID, networkID, stateDir string) (portDetail, bool, error) {
+	ports, err := client.PortsByName(containerID, networkID)
+	if err != nil || len(ports) == 0 {
+		return portDetail{}, false, err
+	}
+
+	if cs, err := loadContainerState(containerID, stateDir); err == nil {
+		for _, p := range ports {
+			if p.ID == cs.NeutronPortID {
+				return p, true, nil
+			}
+		}
+	}
+	return ports[0], true, nil
 }
 
 func saveContainerState(id string, cs ContainerState, stateDir string) error {
@@ -278,56 +593,158 @@ func removeContainerState(id, stateDir string) error {
 	return nil
 }
 
-func cmdDel(args *skel.CmdArgs) error {
+func cmdCheck(args *skel.CmdArgs) error {
 	n, err := loadNetConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	// invoke delegate
-	err = delegateDel(args.ContainerID, n.Delegate)
+	supported, err := version.GreaterThanOrEqualTo(n.CNIVersion, "0.4.0")
 	if err != nil {
-		return fmt.Errorf("error calling delegate : %v", err)
+		return err
+	}
+	if !supported {
+		return fmt.Errorf("CHECK is not supported by CNI version %q", n.CNIVersion)
+	}
+
+	if n.PrevResult == nil {
+		return errors.New("missing 'prevResult' in CHECK")
 	}
 
-	keystoneClient, err := keystone.NewClient(n.KeystoneURL)
+	err = withNeutron(n, func(client *neutronClient) error {
+		return check(args, n, client)
+	})
+	return redactSecrets(err, n)
+}
+
+// check verifies that the container's port is still up and has the
+// addresses recorded by ADD, then has the delegate check the interface.
+func check(args *skel.CmdArgs, n *NetConf, client *neutronClient) error {
+	cs, err := loadContainerState(args.ContainerID, n.StateDir)
 	if err != nil {
 		return err
 	}
 
-	// get token for username, password and domain name
-	// TODO: inject domain name as well?
-	auth := keystone.NewAuth(n.KeystoneUsername, n.KeystonePassword, "Default")
-	authToken, err := keystoneClient.Tokens(auth)
+	p, err := client.Port(cs.NeutronPortID)
+	if err != nil {
+		return fmt.Errorf("error looking up neutron port %s: %w", cs.NeutronPortID, err)
+	}
+	if p.Status != "ACTIVE" {
+		return fmt.Errorf("neutron port %s is %s, expected ACTIVE", p.ID, p.Status)
+	}
+
+	setDelegatePort(n, p)
+
+	cidr, cidr6, err := setDelegateAddresses(client, n, p.Port)
 	if err != nil {
 		return err
 	}
+	if cidr != cs.IP {
+		return fmt.Errorf("neutron port %s has address %s, expected %s", p.ID, cidr, cs.IP)
+	}
+	if cidr6 != cs.IP6 {
+		return fmt.Errorf("neutron port %s has IPv6 address %q, expected %q", p.ID, cidr6, cs.IP6)
+	}
 
-	client, err := neutron.NewClient(n.NeutronURL, authToken)
+	prevResult, err := current.NewResultFromResult(n.PrevResult)
 	if err != nil {
 		return err
 	}
+	for _, addr := range []string{cidr, cidr6} {
+		if addr != "" && !hasAddress(prevResult, addr) {
+			return fmt.Errorf("address %s of neutron port %s is missing from prevResult", addr, p.ID)
+		}
+	}
 
-	// load container state (ip, neutron port id)
-	cs, err := loadContainerState(args.ContainerID, n.StateDir)
+	if err := delegateCheck(args.ContainerID, n.Delegate); err != nil {
+		return fmt.Errorf("error calling delegate : %w", err)
+	}
+	return nil
+}
+
+// hasAddress reports whether a result has the address of a host route such
+// as 10.0.3.20/32, whatever the prefix length of the result's address.
+func hasAddress(result *current.Result, cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return false
+	}
+	for _, ipc := range result.IPs {
+		if ipc.Address.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	n, err := loadNetConfig(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	// delete neutron port
-	err = client.DeletePort(cs.NeutronPortID)
+	// invoke delegate
+	err = delegateDel(args.ContainerID, n.Delegate)
 	if err != nil {
-		return fmt.Errorf("error calling neutron delete port: %v", err)
+		return fmt.Errorf("error calling delegate : %w", err)
 	}
 
-	// remove container state file
-	err = removeContainerState(args.ContainerID, n.StateDir)
+	err = withNeutron(n, func(client *neutronClient) error {
+		return del(args, n, client)
+	})
+	return redactSecrets(err, n)
+}
+
+func del(args *skel.CmdArgs, n *NetConf, client *neutronClient) error {
+	// load container state (ip, neutron port id); without it an earlier DEL
+	// already finished
+	cs, err := loadContainerState(args.ContainerID, n.StateDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return err
+
+	// delete neutron port, which an earlier DEL may have done before failing
+	err = client.DeletePort(cs.NeutronPortID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error calling neutron delete port: %w", err)
+	}
+
+	// best effort, the next DEL on the network tries again
+	if n.DeleteEmptyNetworks && cs.NetworkID != "" {
+		if err := deleteNetworkIfEmpty(client, n, networkName(n), cs.NetworkID); err != nil {
+			fmt.Fprintf(os.Stderr, "gofer: error deleting empty network %s: %v\n", cs.NetworkID, err)
+		}
+	}
+
+	// remove container state file
+	return removeContainerState(args.ContainerID, n.StateDir)
+}
+
+// commands gofer runs for operators next to being a CNI plugin
+var commands = map[string]func(args []string) error{
+	// turns Cloud Foundry network policies between policy groups into rules
+	// of their security groups
+	"policy-sync": runPolicySync,
+	// removes the ports and state files of gone containers
+	"gc": runGC,
+	// prints the container addresses on each host, which the ovs plugin's
+	// tunnels command programs the tunnels between hosts from
+	"peers": runPeers,
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "gofer %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "gofer: Neutron networking for Cloud Foundry containers")
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// ensureNetwork finds or creates the network (and its subnet) for a space.
+// Creation is serialized on this host by a lock in the state dir, and hosts
+// racing each other converge on one network, see pickOldest. An existing
+// network is repaired first, see repairNetwork. Resources kept are recorded
+// in rb.
+func ensureNetwork(client *neutronClient, n *NetConf, networkName string, rb *rollback) (networkDetail, error) {
+	lock, err := lockFile(lockPath(n.StateDir, "network", networkName))
+	if err != nil {
+		return networkDetail{}, err
+	}
+	defer lock.Unlock()
+
+	networks, err := client.NetworksByName(networkName, ownerTags(n))
+	if err == nil && len(networks) == 0 {
+		networks, err = adoptNetworks(client, n, networkName)
+	}
+	if err != nil {
+		return networkDetail{}, err
+	}
+	if len(networks) > 0 {
+		network := pickNetwork(networks)
+		if err := repairNetwork(client, n, network.ID); err != nil {
+			return networkDetail{}, err
+		}
+		return network, nil
+	}
+
+	created := &rollback{}
+	network, err := createNetwork(client, n, networkName, created)
+	if err != nil {
+		return networkDetail{}, created.run(err)
+	}
+
+	networks, err = client.NetworksByName(networkName, ownerTags(n))
+	if err != nil {
+		return networkDetail{}, created.run(err)
+	}
+
+	winner := pickNetwork(append(networks, network))
+	if winner.ID != network.ID {
+		// another host created the network first, use theirs
+		if err := created.run(nil); err != nil {
+			return networkDetail{}, err
+		}
+		return winner, nil
+	}
+
+	rb.adopt(created)
+	return network, nil
+}
+
+func pickNetwork(networks []networkDetail) networkDetail {
+	return networks[pickOldest(len(networks), func(i int) (string, string) {
+		return networks[i].CreatedAt, networks[i].ID
+	})]
+}
+
+// adoptNetworks tags and returns the untagged networks of a space.
+func adoptNetworks(client *neutronClient, n *NetConf, networkName string) ([]networkDetail, error) {
+	networks, err := client.NetworksByName(networkName, nil)
+	if err != nil {
+		return nil, err
+	}
+	var adopted []networkDetail
+	for _, network := range networks {
+		ok, err := adoptUntagged(client, "networks", network.ID, network.Tags, networkTags(n))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			adopted = append(adopted, network)
+		}
+	}
+	return adopted, nil
+}
+
+// networkTags are the tags of a space network and its subnets.
+func networkTags(n *NetConf) []string {
+	return resourceTags(n, "org_id", "space_id")
+}
+
+func createNetwork(client *neutronClient, n *NetConf, networkName string, rb *rollback) (networkDetail, error) {
+	// create network
+	net := networkRequest{
+		Name:         networkName,
+		Description:  networkName,
+		AdminStateUp: true,
+		Tags:         networkTags(n),
+	}
+	network, err := client.CreateNetwork(net)
+	if err != nil {
+		return network, err
+	}
+	rb.add("delete network "+network.ID, func() error {
+		return client.DeleteNetwork(network.ID)
+	})
+
+	subnetIDs, err := createSubnets(client, n, network.ID, nil, rb)
+	if err != nil {
+		return network, err
+	}
+
+	if n.ManageRouters {
+		if err := attachSubnets(client, n, subnetIDs, rb); err != nil {
+			return network, err
+		}
+	}
+	return network, nil
+}
+
+// createSubnets creates the subnets a space network is missing: the IPv4
+// one, and the IPv6 one when 'ipv6_mode' is set. It returns the IDs of all
+// subnets of the network.
+func createSubnets(client *neutronClient, n *NetConf, networkID string, existing []neutronSubnet, rb *rollback) ([]string, error) {
+	var subnetIDs []string
+	have := map[int]bool{}
+	for _, s := range existing {
+		subnetIDs = append(subnetIDs, s.ID)
+		have[s.IPVersion] = true
+	}
+	if have[4] && (have[6] || n.IPv6Mode == "") {
+		return subnetIDs, nil
+	}
+
+	// pick a free CIDR and create the subnet before anyone else on this host
+	// can take it
+	lock, err := lockFile(supernetLockPath(n.StateDir))
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	if !have[4] {
+		s, err := createSubnet(client, func() (neutronSubnet, error) {
+			return newSubnet(client, n, networkID)
+		}, n.Supernet != "", rb)
+		if err != nil {
+			return nil, err
+		}
+		subnetIDs = append(subnetIDs, s.ID)
+	}
+
+	if n.IPv6Mode != "" && !have[6] {
+		s6, err := createSubnet(client, func() (neutronSubnet, error) {
+			return newSubnet6(client, n, networkID)
+		}, n.IPv6Supernet != "", rb)
+		if err != nil {
+			return nil, err
+		}
+		subnetIDs = append(subnetIDs, s6.ID)
+	}
+	return subnetIDs, nil
+}
+
+// repairNetwork restores the subnets and router interfaces of a space
+// network that deleteNetworkIfEmpty on another host took apart before a
+// new port made it give up. The repairs are kept even if ADD fails later.
+func repairNetwork(client *neutronClient, n *NetConf, networkID string) error {
+	subnets, err := client.NetworkSubnets(networkID)
+	if err != nil {
+		return err
+	}
+	subnetIDs, err := createSubnets(client, n, networkID, subnets, &rollback{})
+	if err != nil {
+		return err
+	}
+	if !n.ManageRouters {
+		return nil
+	}
+
+	q := url.Values{}
+	q.Set("network_id", networkID)
+	interfaces, err := client.RouterInterfaces(q)
+	if err != nil {
+		return err
+	}
+	attached := map[string]bool{}
+	for _, iface := range interfaces {
+		for _, fixedIP := range iface.FixedIPs {
+			attached[fixedIP.SubnetID] = true
+		}
+	}
+	var detached []string
+	for _, id := range subnetIDs {
+		if !attached[id] {
+			detached = append(detached, id)
+		}
+	}
+	if len(detached) == 0 {
+		return nil
+	}
+	return attachSubnets(client, n, detached, &rollback{})
+}
+
+// deleteNetworkIfEmpty deletes a space network and its subnets once no
+// compute ports are left on it, detaching the subnets from the org router
+// first. It takes the same lock as ensureNetwork, which only serializes this
+// host; a port another host creates in the meantime makes Neutron refuse the
+// deletes, and the network is repaired for that port.
+func deleteNetworkIfEmpty(client *neutronClient, n *NetConf, networkName, networkID string) error {
+	lock, err := lockFile(lockPath(n.StateDir, "network", networkName))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	q := url.Values{}
+	q.Set("network_id", networkID)
+	ports, err := client.PortSummaries(q)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		if isContainerPort(p.DeviceOwner) {
+			return nil
+		}
+	}
+
+	interfaces, err := client.RouterInterfaces(q)
+	if err != nil {
+		return err
+	}
+	if len(interfaces) > 0 {
+		if err := detachRouterInterfaces(client, n, interfaces); err != nil {
+			return err
+		}
+	}
+
+	subnets, err := client.NetworkSubnets(networkID)
+	if err != nil {
+		return err
+	}
+	for _, s := range subnets {
+		err := client.DeleteSubnet(s.ID)
+		if isConflict(err) {
+			return repairNetwork(client, n, networkID)
+		}
+		if err != nil && !isNotFound(err) {
+			return fmt.Errorf("error deleting subnet %s: %w", s.ID, err)
+		}
+	}
+
+	err = client.DeleteNetwork(networkID)
+	if isConflict(err) {
+		return repairNetwork(client, n, networkID)
+	}
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("error deleting network %s: %w", networkID, err)
+	}
+	return nil
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/markstgodard/go-neutron/neutron"
+)
+
+// neutronClient extends go-neutron with the Neutron v2.0 API calls it lacks.
+type neutronClient struct {
+	*neutron.Client
+	endpoint string
+	token    string
+
+	// tokens replaces a token Neutron rejects, if set
+	tokens *tokenCache
+}
+
+func newNeutronClient(endpoint, token string) (*neutronClient, error) {
+	client, err := neutron.NewClient(endpoint, token)
+	if err != nil {
+		return nil, err
+	}
+	return &neutronClient{
+		Client:   client,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		token:    token,
+	}, nil
+}
+
+type neutronError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *neutronError) Error() string {
+	return fmt.Sprintf("neutron returned %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// do sends a request to Neutron. If Neutron rejects the token, e.g. because
+// it was revoked before it expired, the request is sent once more with a new
+// token, which the client keeps using.
+func (c *neutronClient) do(method, path string, in, out interface{}) error {
+	var data []byte
+	if in != nil {
+		var err error
+		data, err = json.Marshal(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	resp, err := c.send(method, path, data)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && c.tokens != nil {
+		resp.Body.Close()
+		if err := c.refreshToken(); err != nil {
+			return err
+		}
+		resp, err = c.send(method, path, data)
+		if err != nil {
+			return err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return &neutronError{StatusCode: resp.StatusCode, Body: string(msg)}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *neutronClient) send(method, path string, data []byte) (*http.Response, error) {
+	var body io.Reader
+	if data != nil {
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.endpoint+"/v2.0"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Auth-Token", c.token)
+	req.Header.Set("Accept", "application/json")
+	if data != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return httpClient.Do(req)
+}
+
+// refreshToken drops the rejected token from the cache and switches to a
+// new one.
+func (c *neutronClient) refreshToken() error {
+	if err := c.tokens.Invalidate(c.token); err != nil {
+		return err
+	}
+	token, err := c.tokens.Token()
+	if err != nil {
+		return err
+	}
+	client, err := neutron.NewClient(c.endpoint, token)
+	if err != nil {
+		return err
+	}
+	c.Client, c.token = client, token
+	return nil
+}
+
+// PortsByName returns the ports on a network with the given name.
+func (c *neutronClient) PortsByName(name, networkID string) ([]portDetail, error) {
+	q := url.Values{}
+	q.Set("name", name)
+	q.Set("network_id", networkID)
+
+	var resp struct {
+		Ports []portDetail `json:"ports"`
+	}
+	if err := c.do(http.MethodGet, "/ports?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ports, nil
+}
+
+// networkRequest has the network attributes go-neutron does not model, such
+// as tags.
+type networkRequest struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description"`
+	AdminStateUp bool     `json:"admin_state_up"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// CreateNetwork shadows go-neutron's CreateNetwork to support tags.
+func (c *neutronClient) CreateNetwork(network networkRequest) (networkDetail, error) {
+	req := struct {
+		Network networkRequest `json:"network"`
+	}{network}
+
+	var resp struct {
+		Network networkDetail `json:"network"`
+	}
+	if err := c.do(http.MethodPost, "/networks", req, &resp); err != nil {
+		return networkDetail{}, err
+	}
+	return resp.Network, nil
+}
+
+// NetworksByName shadows go-neutron's NetworksByName to only return networks
+// that have all of tags.
+func (c *neutronClient) NetworksByName(name string, tags []string) ([]networkDetail, error) {
+	q := url.Values{}
+	q.Set("name", name)
+
+	var resp struct {
+		Networks []networkDetail `json:"networks"`
+	}
+	if err := c.do(http.MethodGet, "/networks?"+withTags(q, tags).Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Networks, nil
+}
+
+// networkDetail has the network attributes go-neutron does not model: when
+// it was created, and the provider attributes, which only admins may read by
+// default.
+type networkDetail struct {
+	neutron.Network
+	Tags           []string `json:"tags"`
+	CreatedAt      string   `json:"created_at"`
+	NetworkType    string   `json:"provider:network_type"`
+	SegmentationID *int     `json:"provider:segmentation_id"`
+}
+
+// ReplaceTags sets the tags of a resource in a collection such as
+// "networks".
+func (c *neutronClient) ReplaceTags(collection, id string, tags []string) error {
+	req := struct {
+		Tags []string `json:"tags"`
+	}{tags}
+	return c.do(http.MethodPut, "/"+collection+"/"+id+"/tags", req, nil)
+}
+
+func (c *neutronClient) Network(id string) (networkDetail, error) {
+	var resp struct {
+		Network networkDetail `json:"network"`
+	}
+	if err := c.do(http.MethodGet, "/networks/"+id, nil, &resp); err != nil {
+		return networkDetail{}, err
+	}
+	return resp.Network, nil
+}
+
+func (c *neutronClient) DeleteNetwork(id string) error {
+	return c.do(http.MethodDelete, "/networks/"+id, nil, nil)
+}
+
+func (c *neutronClient) DeleteSubnet(id string) error {
+	return c.do(http.MethodDelete, "/subnets/"+id, nil, nil)
+}
+
+type allocationPool struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// neutronSubnet has the subnet attributes go-neutron does not model, such as
+// subnet pools and IPv6 modes.
+type neutronSubnet struct {
+	ID              string           `json:"id,omitempty"`
+	NetworkID       string           `json:"network_id,omitempty"`
+	IPVersion       int              `json:"ip_version,omitempty"`
+	CIDR            string           `json:"cidr,omitempty"`
+	SubnetPoolID    string           `json:"subnetpool_id,omitempty"`
+	PrefixLen       int              `json:"prefixlen,omitempty"`
+	AllocationPools []allocationPool `json:"allocation_pools,omitempty"`
+	IPv6RAMode      string           `json:"ipv6_ra_mode,omitempty"`
+	IPv6AddressMode string           `json:"ipv6_address_mode,omitempty"`
+	GatewayIP       string           `json:"gateway_ip,omitempty"`
+	HostRoutes      []hostRoute      `json:"host_routes,omitempty"`
+	DNSNameservers  []string         `json:"dns_nameservers,omitempty"`
+	Tags            []string         `json:"tags,omitempty"`
+	CreatedAt       string           `json:"created_at,omitempty"`
+}
+
+type hostRoute struct {
+	Destination string `json:"destination"`
+	NextHop     string `json:"nexthop"`
+}
+
+// CreateSubnet shadows go-neutron's CreateSubnet to support subnet pools and
+// IPv6 address modes.
+func (c *neutronClient) CreateSubnet(subnet neutronSubnet) (neutronSubnet, error) {
+	req := struct {
+		Subnet neutronSubnet `json:"subnet"`
+	}{subnet}
+
+	var resp struct {
+		Subnet neutronSubnet `json:"subnet"`
+	}
+	if err := c.do(http.MethodPost, "/subnets", req, &resp); err != nil {
+		return neutronSubnet{}, err
+	}
+	return resp.Subnet, nil
+}
+
+func (c *neutronClient) Subnet(id string) (neutronSubnet, error) {
+	var resp struct {
+		Subnet neutronSubnet `json:"subnet"`
+	}
+	if err := c.do(http.MethodGet, "/subnets/"+id, nil, &resp); err != nil {
+		return neutronSubnet{}, err
+	}
+	return resp.Subnet, nil
+}
+
+// Subnets lists the subnets visible to us with the given IP version.
+func (c *neutronClient) Subnets(ipVersion int) ([]neutronSubnet, error) {
+	q := url.Values{}
+	q.Set("ip_version", fmt.Sprint(ipVersion))
+
+	var resp struct {
+		Subnets []neutronSubnet `json:"subnets"`
+	}
+	if err := c.do(http.MethodGet, "/subnets?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Subnets, nil
+}
+
+func (c *neutronClient) NetworkSubnets(networkID string) ([]neutronSubnet, error) {
+	q := url.Values{}
+	q.Set("network_id", networkID)
+
+	var resp struct {
+		Subnets []neutronSubnet `json:"subnets"`
+	}
+	if err := c.do(http.MethodGet, "/subnets?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Subnets, nil
+}
+
+type neutronRouter struct {
+	ID                  string               `json:"id,omitempty"`
+	Name                string               `json:"name,omitempty"`
+	AdminStateUp        bool                 `json:"admin_state_up"`
+	ExternalGatewayInfo *externalGatewayInfo `json:"external_gateway_info,omitempty"`
+	Tags                []string             `json:"tags,omitempty"`
+	CreatedAt           string               `json:"created_at,omitempty"`
+}
+
+type externalGatewayInfo struct {
+	NetworkID string `json:"network_id"`
+}
+
+// routerInterface is a port connecting a router to a subnet.
+type routerInterface struct {
+	ID       string        `json:"id"`
+	DeviceID string        `json:"device_id"`
+	FixedIPs []portFixedIP `json:"fixed_ips"`
+}
+
+type portFixedIP struct {
+	SubnetID  string `json:"subnet_id"`
+	IPAddress string `json:"ip_address"`
+}
+
+func (c *neutronClient) RoutersByName(name string, tags []string) ([]neutronRouter, error) {
+	q := url.Values{}
+	q.Set("name", name)
+
+	var resp struct {
+		Routers []neutronRouter `json:"routers"`
+	}
+	if err := c.do(http.MethodGet, "/routers?"+withTags(q, tags).Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Routers, nil
+}
+
+func (c *neutronClient) CreateRouter(router neutronRouter) (neutronRouter, error) {
+	req := struct {
+		Router neutronRouter `json:"router"`
+	}{router}
+
+	var resp struct {
+		Router neutronRouter `json:"router"`
+	}
+	if err := c.do(http.MethodPost, "/routers", req, &resp); err != nil {
+		return neutronRouter{}, err
+	}
+	return resp.Router, nil
+}
+
+func (c *neutronClient) DeleteRouter(id string) error {
+	return c.do(http.MethodDelete, "/routers/"+id, nil, nil)
+}
+
+func (c *neutronClient) AddRouterInterface(routerID, subnetID string) error {
+	req := map[string]string{"subnet_id": subnetID}
+	return c.do(http.MethodPut, "/routers/"+routerID+"/add_router_interface", req, nil)
+}
+
+func (c *neutronClient) RemoveRouterInterface(routerID, subnetID string) error {
+	req := map[string]string{"subnet_id": subnetID}
+	return c.do(http.MethodPut, "/routers/"+routerID+"/remove_router_interface", req, nil)
+}
+
+// RouterInterfaces lists router interface ports matching the filter, e.g.
+// by device_id for a router's interfaces.
+func (c *neutronClient) RouterInterfaces(filter url.Values) ([]routerInterface, error) {
+	q := url.Values{}
+	for k, v := range filter {
+		q[k] = v
+	}
+	q.Set("device_owner", "network:router_interface")
+
+	var resp struct {
+		Ports []routerInterface `json:"ports"`
+	}
+	if err := c.do(http.MethodGet, "/ports?"+q.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ports, nil
+}
+
+func isNotFound(err error) bool {
+	var nerr *neutronError
+	return errors.As(err, &nerr) && nerr.StatusCode == http.StatusNotFound
+}
+
+func isConflict(err error) bool {
+	var nerr *neutronError
+	return errors.As(err, &nerr) && nerr.StatusCode == http.StatusConflict
+}
+
+// portRequest has the port attributes go-neutron does not model, such as
+// security groups, port security, tags and the host the port is bound to.
+type portRequest struct {
+	NetworkID           string   `json:"network_id"`
+	Name                string   `json:"name"`
+	AdminStateUp        bool     `json:"admin_state_up"`
+	DeviceOwner         string   `json:"device_owner,omitempty"`
+	DeviceID            string   `json:"device_id,omitempty"`
+	SecurityGroups      []string `json:"security_groups,omitempty"`
+	PortSecurityEnabled *bool    `json:"port_security_enabled,omitempty"`
+	Tags                []string `json:"tags,omitempty"`
+	HostID              string   `json:"binding:host_id,omitempty"`
+}
+
+// CreatePort shadows go-neutron's CreatePort to support security groups and
+// tags.
+func (c *neutronClient) CreatePort(port portRequest) (portDetail, error) {
+	req := struct {
+		Port portRequest `json:"port"`
+	}{port}
+
+	var resp struct {
+		Port portDetail `json:"port"`
+	}
+	if err := c.do(http.MethodPost, "/ports", req, &resp); err != nil {
+		return portDetail{}, err
+	}
+	return resp.Port, nil
+}
+
+// DeletePort shadows go-neutron's DeletePort, whose errors do not carry the
+// HTTP status.
+func (c *neutronClient) DeletePort(id string) error {
+	return c.do(http.MethodDelete, "/ports/"+id, nil, nil)
+}
+
+// portDetail is a port with its status and MAC address, which go-neutron
+// does not model.
+type portDetail struct {
+	neutron.Port
+	Status     string `json:"status"`
+	MACAddress string `json:"mac_address"`
+}
+
+func (c *neutronClient) Port(id string) (portDetail, error) {
+	var resp struct {
+		Port portDetail `json:"port"`
+	}
+	if err := c.do(http.MethodGet, "/ports/"+id, nil, &resp); err != nil {
+		return portDetail{}, err
+	}
+	return resp.Port, nil
+}
+
+// portSummary is what gofer's housekeeping needs to know about a port.
+type portSummary struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DeviceOwner string `json:"device_owner"`
+	DeviceID    string `json:"device_id"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func (c *neutronClient) PortSummaries(filter url.Values) ([]portSummary, error) {
+	var resp struct {
+		Ports []portSummary `json:"ports"`
+	}
+	if err := c.do(http.MethodGet, "/ports?"+filter.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ports, nil
+}
+
+// portBinding is a port with the host it is on, for the tunnel mesh.
+type portBinding struct {
+	neutron.Port
+	MACAddress string   `json:"mac_address"`
+	HostID     string   `json:"binding:host_id"`
+	Tags       []string `json:"tags"`
+}
+
+func (c *neutronClient) PortBindings(filter url.Values) ([]portBinding, error) {
+	var resp struct {
+		Ports []portBinding `json:"ports"`
+	}
+	if err := c.do(http.MethodGet, "/ports?"+filter.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Ports, nil
+}
+
+type securityGroup struct {
+	ID          string   `json:"id,omitempty"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags,omitempty"`
+	CreatedAt   string   `json:"created_at,omitempty"`
+}
+
+type securityGroupRule struct {
+	ID              string `json:"id,omitempty"`
+	SecurityGroupID string `json:"security_group_id"`
+	Direction       string `json:"direction"`
+	EtherType       string `json:"ethertype"`
+	Protocol        string `json:"protocol,omitempty"`
+	PortRangeMin    int    `json:"port_range_min,omitempty"`
+	PortRangeMax    int    `json:"port_range_max,omitempty"`
+	RemoteGroupID   string `json:"remote_group_id,omitempty"`
+	Description     string `json:"description,omitempty"`
+}
+
+func (c *neutronClient) SecurityGroupsByName(name string, tags []string) ([]securityGroup, error) {
+	q := url.Values{}
+	q.Set("name", name)
+
+	var resp struct {
+		SecurityGroups []securityGroup `json:"security_groups"`
+	}
+	if err := c.do(http.MethodGet, "/security-groups?"+withTags(q, tags).Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SecurityGroups, nil
+}
+
+// SecurityGroups lists the security groups that have all of tags.
+func (c *neutronClient) SecurityGroups(tags []string) ([]securityGroup, error) {
+	var resp struct {
+		SecurityGroups []securityGroup `json:"security_groups"`
+	}
+	if err := c.do(http.MethodGet, "/security-groups?"+withTags(url.Values{}, tags).Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SecurityGroups, nil
+}
+
+func (c *neutronClient) CreateSecurityGroup(group securityGroup) (securityGroup, error) {
+	req := struct {
+		SecurityGroup securityGroup `json:"security_group"`
+	}{group}
+
+	var resp struct {
+		SecurityGroup securityGroup `json:"security_group"`
+	}
+	if err := c.do(http.MethodPost, "/security-groups", req, &resp); err != nil {
+		return securityGroup{}, err
+	}
+	return resp.SecurityGroup, nil
+}
+
+func (c *neutronClient) DeleteSecurityGroup(id string) error {
+	return c.do(http.MethodDelete, "/security-groups/"+id, nil, nil)
+}
+
+func (c *neutronClient) CreateSecurityGroupRule(rule securityGroupRule) error {
+	req := struct {
+		SecurityGroupRule securityGroupRule `json:"security_group_rule"`
+	}{rule}
+	return c.do(http.MethodPost, "/security-group-rules", req, nil)
+}
+
+// SecurityGroupRules lists the security group rules matching the filter,
+// e.g. by description for the rules gofer manages.
+func (c *neutronClient) SecurityGroupRules(filter url.Values) ([]securityGroupRule, error) {
+	var resp struct {
+		SecurityGroupRules []securityGroupRule `json:"security_group_rules"`
+	}
+	if err := c.do(http.MethodGet, "/security-group-rules?"+filter.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.SecurityGroupRules, nil
+}
+
+func (c *neutronClient) DeleteSecurityGroupRule(id string) error {
+	return c.do(http.MethodDelete, "/security-group-rules/"+id, nil, nil)
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 )
 
@@ -15,6 +18,66 @@ type NetConf struct {
 	Bridge string `json:"bridge"`
 	IP     string `json:"ip"`
 	CIDR   string `json:"cidr"`
+	IP6    string `json:"ip6"`
+	CIDR6  string `json:"cidr6"`
+
+	Subnet  *subnetConf `json:"subnet"`
+	Subnet6 *subnetConf `json:"subnet6"`
+
+	// lets tests exercise a failing delegate
+	FailAdd   bool `json:"fail_add"`
+	FailCheck bool `json:"fail_check"`
+
+	// lets tests see the config of ADD
+	RecordConfig string `json:"record_config"`
+}
+
+type subnetConf struct {
+	CIDR           string      `json:"cidr"`
+	Gateway        string      `json:"gateway"`
+	Routes         []routeConf `json:"routes"`
+	DNSNameservers []string    `json:"dns_nameservers"`
+}
+
+type routeConf struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw"`
+}
+
+// ipConfig reports the gateway and routes a real delegate would set up for
+// an address in subnet s, without touching any network namespace.
+func ipConfig(cidr string, s *subnetConf, defaultDst string) (*current.IPConfig, []*types.Route, error) {
+	_, ipn, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &current.IPConfig{
+		Interface: current.Int(0),
+		Address: net.IPNet{
+			IP:   ipn.IP,
+			Mask: ipn.Mask,
+		},
+	}
+	if s == nil {
+		return c, nil, nil
+	}
+
+	routes := []routeConf{{Dst: s.CIDR}}
+	if s.Gateway != "" {
+		c.Gateway = net.ParseIP(s.Gateway)
+		routes = append(routes, routeConf{Dst: defaultDst, GW: s.Gateway})
+	}
+	routes = append(routes, s.Routes...)
+
+	var result []*types.Route
+	for _, r := range routes {
+		_, dst, err := net.ParseCIDR(r.Dst)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, &types.Route{Dst: *dst, GW: net.ParseIP(r.GW)})
+	}
+	return c, result, nil
 }
 
 func loadNetConfig(stdin []byte) (*NetConf, error) {
@@ -31,21 +94,58 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return err
 	}
 
-	result := types.Result{}
-	if n.CIDR != "" {
-		_, ipn, err := net.ParseCIDR(n.CIDR)
+	if n.FailAdd {
+		return errors.New("noop ADD failed")
+	}
+
+	if n.RecordConfig != "" {
+		if err := ioutil.WriteFile(n.RecordConfig, args.StdinData, 0600); err != nil {
+			return err
+		}
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{{Name: args.IfName, Sandbox: args.Netns}},
+	}
+	for _, addr := range []struct {
+		cidr       string
+		subnet     *subnetConf
+		defaultDst string
+	}{
+		{n.CIDR, n.Subnet, "0.0.0.0/0"},
+		{n.CIDR6, n.Subnet6, "::/0"},
+	} {
+		if addr.cidr == "" {
+			continue
+		}
+		ipc, routes, err := ipConfig(addr.cidr, addr.subnet, addr.defaultDst)
 		if err != nil {
 			return err
 		}
-		result.IP4 = &types.IPConfig{
-			IP: net.IPNet{
-				IP:   ipn.IP,
-				Mask: ipn.Mask,
-			},
+		result.IPs = append(result.IPs, ipc)
+		result.Routes = append(result.Routes, routes...)
+	}
+
+	for _, s := range []*subnetConf{n.Subnet, n.Subnet6} {
+		if s != nil {
+			result.DNS.Nameservers = append(result.DNS.Nameservers, s.DNSNameservers...)
 		}
 	}
 
-	return result.Print()
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConfig(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.FailCheck {
+		return errors.New("noop CHECK failed")
+	}
+	return nil
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -53,5 +153,5 @@ func cmdDel(args *skel.CmdArgs) error {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "noop: test delegate for gofer")
 }
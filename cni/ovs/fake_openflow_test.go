@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// fakeSwitch is an OpenFlow 1.3 switch on a unix socket that supports the
+// bundle extension, recording the flow mods of committed bundles.
+type fakeSwitch struct {
+	listener net.Listener
+
+	mu sync.Mutex
+	// the flow table, as the flow mods that added the flows without their
+	// header
+	flowMods [][]byte
+	bundles  int
+	// rejects flow mods for this table if set
+	rejectTable *uint8
+	echoReplies int
+}
+
+func newFakeSwitch(socket string) (*fakeSwitch, error) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeSwitch{listener: listener}
+	go s.serve()
+	return s, nil
+}
+
+func (s *fakeSwitch) Close() error {
+	return s.listener.Close()
+}
+
+func (s *fakeSwitch) installed() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.flowMods...)
+}
+
+func (s *fakeSwitch) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSwitch) handle(conn net.Conn) {
+	defer conn.Close()
+
+	send := func(msgType uint8, xid uint32, body []byte) {
+		conn.Write(openflowMessage(msgType, xid, body))
+	}
+	sendError := func(xid uint32, errType, code uint16) {
+		body := make([]byte, 4)
+		binary.BigEndian.PutUint16(body, errType)
+		binary.BigEndian.PutUint16(body[2:], code)
+		send(ofptError, xid, body)
+	}
+
+	send(ofptHello, 1, nil)
+	// keepalive, as ovs-vswitchd sends when a connection is idle
+	send(ofptEchoRequest, 2, nil)
+
+	bundles := map[uint32][][]byte{}
+	failed := map[uint32]bool{}
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[2:])-8)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		xid := binary.BigEndian.Uint32(header[4:])
+		if header[0] != ofpVersion {
+			sendError(xid, 0, 0) // OFPET_HELLO_FAILED
+			return
+		}
+
+		switch header[1] {
+		case ofptEchoReply:
+			s.mu.Lock()
+			s.echoReplies++
+			s.mu.Unlock()
+
+		case ofptExperimenter:
+			if binary.BigEndian.Uint32(body) != onfExperimenterID {
+				sendError(xid, 1, 3) // OFPBRC_BAD_EXPERIMENTER
+				continue
+			}
+			bundleID := binary.BigEndian.Uint32(body[8:])
+
+			switch binary.BigEndian.Uint32(body[4:]) {
+			case onftBundleControl:
+				switch binary.BigEndian.Uint16(body[12:]) {
+				case bundleOpenRequest:
+					bundles[bundleID] = [][]byte{}
+					send(ofptExperimenter, xid, bundleControl(bundleID, bundleOpenReply))
+				case bundleCommitRequest:
+					mods, open := bundles[bundleID]
+					delete(bundles, bundleID)
+					if !open || failed[bundleID] {
+						sendError(xid, 17, 0) // OFPET_BUNDLE_FAILED
+						continue
+					}
+					s.mu.Lock()
+					for _, mod := range mods {
+						s.apply(mod)
+					}
+					s.bundles++
+					s.mu.Unlock()
+					send(ofptExperimenter, xid, bundleControl(bundleID, bundleCommitReply))
+				}
+
+			case onftBundleAddMessage:
+				msg := body[16:]
+				if _, open := bundles[bundleID]; !open || msg[1] != ofptFlowMod || binary.BigEndian.Uint32(msg[4:]) != xid {
+					sendError(xid, 17, 0)
+					continue
+				}
+				mod := msg[8:]
+				s.mu.Lock()
+				reject := s.rejectTable != nil && mod[16] == *s.rejectTable
+				s.mu.Unlock()
+				if reject {
+					failed[bundleID] = true
+					sendError(xid, 5, 0) // OFPFMFC_UNKNOWN
+					continue
+				}
+				bundles[bundleID] = append(bundles[bundleID], mod)
+			}
+		}
+	}
+}
+
+// apply adds the flow of a flow mod to the table, or deletes the flows
+// matching its cookie for deletes. Deletes do not match on fields here.
+func (s *fakeSwitch) apply(mod []byte) {
+	if mod[17] != ofpfcDelete {
+		s.flowMods = append(s.flowMods, mod)
+		return
+	}
+
+	cookie, mask := binary.BigEndian.Uint64(mod), binary.BigEndian.Uint64(mod[8:])
+	var kept [][]byte
+	for _, flow := range s.flowMods {
+		if binary.BigEndian.Uint64(flow)&mask != cookie&mask {
+			kept = append(kept, flow)
+		}
+	}
+	s.flowMods = kept
+}
+
+// describeFlowMod formats a flow mod like ovs-ofctl does.
+func describeFlowMod(mod []byte) string {
+	var fields []string
+	fields = append(fields,
+		fmt.Sprintf("cookie=%#x", binary.BigEndian.Uint64(mod)),
+		fmt.Sprintf("table=%d", mod[16]),
+		fmt.Sprintf("priority=%d", binary.BigEndian.Uint16(mod[22:])))
+
+	matchLen := int(binary.BigEndian.Uint16(mod[42:]))
+	fields = append(fields, describeOXM(mod[44:40+matchLen])...)
+
+	rest := mod[40+(matchLen+7)/8*8:]
+	var actions []string
+	for len(rest) > 0 {
+		length := binary.BigEndian.Uint16(rest[2:])
+		switch binary.BigEndian.Uint16(rest) {
+		case ofpitApplyActions:
+			for a := rest[8:length]; len(a) > 0; a = a[binary.BigEndian.Uint16(a[2:]):] {
+				switch binary.BigEndian.Uint16(a) {
+				case ofpatOutput:
+					actions = append(actions, fmt.Sprintf("output:%d", binary.BigEndian.Uint32(a[4:])))
+				case ofpatSetField:
+					field := describeOXM(a[4:])[0]
+					parts := strings.SplitN(field, "=", 2)
+					actions = append(actions, fmt.Sprintf("set_field:%s->%s", parts[1], parts[0]))
+				}
+			}
+		case ofpitGotoTable:
+			actions = append(actions, fmt.Sprintf("goto_table:%d", rest[4]))
+		}
+		rest = rest[length:]
+	}
+
+	return strings.Join(fields, ",") + " actions=" + strings.Join(actions, ",")
+}
+
+func describeOXM(b []byte) []string {
+	var fields []string
+	for len(b) >= 4 && binary.BigEndian.Uint16(b) == oxmClassOpenFlow {
+		field, length := b[2]>>1, int(b[3])
+		value := b[4 : 4+length]
+		switch field {
+		case oxmInPort:
+			fields = append(fields, fmt.Sprintf("in_port=%d", binary.BigEndian.Uint32(value)))
+		case oxmEthDst:
+			fields = append(fields, fmt.Sprintf("dl_dst=%s", net.HardwareAddr(value)))
+		case oxmEthType:
+			fields = append(fields, fmt.Sprintf("dl_type=0x%04x", binary.BigEndian.Uint16(value)))
+		case oxmIPProto:
+			fields = append(fields, fmt.Sprintf("nw_proto=%d", value[0]))
+		case oxmARPTPA:
+			fields = append(fields, fmt.Sprintf("arp_tpa=%s", net.IP(value)))
+		case oxmICMPv6Type:
+			fields = append(fields, fmt.Sprintf("icmp_type=%d", value[0]))
+		case oxmIPv6NDTarget:
+			fields = append(fields, fmt.Sprintf("nd_target=%s", net.IP(value)))
+		case oxmTunnelID:
+			fields = append(fields, fmt.Sprintf("tun_id=%d", binary.BigEndian.Uint64(value)))
+		default:
+			fields = append(fields, fmt.Sprintf("oxm%d=%x", field, value))
+		}
+		b = b[4+length:]
+	}
+	return fields
+}
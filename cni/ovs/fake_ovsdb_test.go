@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+)
+
+// fakeOVSDB is an in-process ovsdb-server with just enough of RFC 7047 for
+// the operations of ovsdbClient on the Bridge, Port and Interface tables.
+type fakeOVSDB struct {
+	listener net.Listener
+
+	mu           sync.Mutex
+	tables       map[string]map[string]map[string]interface{}
+	transactions int
+	echoReplies  int
+	nextUUID     int
+
+	// interfaces ovs-vswitchd fails to add
+	failInterfaces map[string]bool
+}
+
+func newFakeOVSDB(socket string, bridges ...string) (*fakeOVSDB, error) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fakeOVSDB{
+		listener: listener,
+		tables: map[string]map[string]map[string]interface{}{
+			"Bridge":    {},
+			"Port":      {},
+			"Interface": {},
+		},
+	}
+	for _, name := range bridges {
+		id := f.newUUID()
+		f.tables["Bridge"][id] = map[string]interface{}{
+			"_uuid": []interface{}{"uuid", id},
+			"name":  name,
+			"ports": []interface{}{"set", []interface{}{}},
+		}
+	}
+
+	go f.serve()
+	return f, nil
+}
+
+func (f *fakeOVSDB) Close() error {
+	return f.listener.Close()
+}
+
+// rows returns the rows of a table, with references in JSON form.
+func (f *fakeOVSDB) rows(table string) []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rows := []map[string]interface{}{}
+	for _, row := range f.tables[table] {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (f *fakeOVSDB) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeOVSDB) handle(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+
+	// like the inactivity probe of ovsdb-server
+	enc.Encode(map[string]interface{}{"method": "echo", "params": []interface{}{}, "id": "echo"})
+
+	for {
+		var msg struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+			ID     interface{}       `json:"id"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			return
+		}
+
+		switch msg.Method {
+		case "":
+			if msg.ID == "echo" {
+				f.mu.Lock()
+				f.echoReplies++
+				f.mu.Unlock()
+			}
+		case "transact":
+			enc.Encode(map[string]interface{}{"result": f.transact(msg.Params[1:]), "error": nil, "id": msg.ID})
+		default:
+			enc.Encode(map[string]interface{}{"result": nil, "error": "unknown method", "id": msg.ID})
+		}
+	}
+}
+
+// transact runs the operations on a copy of the tables, which replaces the
+// tables only if all of them succeed.
+func (f *fakeOVSDB) transact(params []json.RawMessage) []interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.transactions++
+
+	tables := map[string]map[string]map[string]interface{}{}
+	for name, rows := range f.tables {
+		tables[name] = map[string]map[string]interface{}{}
+		for id, row := range rows {
+			copied := map[string]interface{}{}
+			for k, v := range row {
+				copied[k] = v
+			}
+			tables[name][id] = copied
+		}
+	}
+
+	named := map[string]string{}
+	var results []interface{}
+	for _, param := range params {
+		var op map[string]interface{}
+		json.Unmarshal(param, &op)
+
+		result, err := f.apply(tables, named, op)
+		if err != nil {
+			return append(results, map[string]interface{}{"error": err.Error(), "details": fmt.Sprint(op["op"])})
+		}
+		results = append(results, result)
+	}
+
+	f.tables = tables
+	f.collectGarbage()
+	f.assignOFPorts()
+	return results
+}
+
+func (f *fakeOVSDB) apply(tables map[string]map[string]map[string]interface{}, named map[string]string, op map[string]interface{}) (map[string]interface{}, error) {
+	table := tables[op["table"].(string)]
+	matches := func() []map[string]interface{} {
+		var rows []map[string]interface{}
+		for _, row := range table {
+			if matchesWhere(row, op["where"]) {
+				rows = append(rows, row)
+			}
+		}
+		return rows
+	}
+
+	switch op["op"] {
+	case "insert":
+		row := resolveNamed(op["row"], named).(map[string]interface{})
+		for _, existing := range table {
+			if existing["name"] == row["name"] {
+				return nil, fmt.Errorf("constraint violation")
+			}
+		}
+		id := f.newUUID()
+		row["_uuid"] = []interface{}{"uuid", id}
+		table[id] = row
+		if name, ok := op["uuid-name"].(string); ok {
+			named[name] = id
+		}
+		return map[string]interface{}{"uuid": []interface{}{"uuid", id}}, nil
+
+	case "select":
+		return map[string]interface{}{"rows": matches()}, nil
+
+	case "wait":
+		var got []interface{}
+		for _, row := range matches() {
+			selected := map[string]interface{}{}
+			for _, column := range op["columns"].([]interface{}) {
+				selected[column.(string)] = row[column.(string)]
+			}
+			got = append(got, selected)
+		}
+		if !reflect.DeepEqual(got, op["rows"]) {
+			return nil, fmt.Errorf("timed out")
+		}
+		return map[string]interface{}{}, nil
+
+	case "mutate":
+		rows := matches()
+		for _, row := range rows {
+			for _, m := range op["mutations"].([]interface{}) {
+				mutation := resolveNamed(m, named).([]interface{})
+				column, mutator := mutation[0].(string), mutation[1].(string)
+				values := setElements(mutation[2])
+
+				var elements []interface{}
+				for _, element := range setElements(row[column]) {
+					if mutator != "delete" || !containsValue(values, element) {
+						elements = append(elements, element)
+					}
+				}
+				if mutator == "insert" {
+					elements = append(elements, values...)
+				}
+				if elements == nil {
+					elements = []interface{}{}
+				}
+				row[column] = []interface{}{"set", elements}
+			}
+		}
+		return map[string]interface{}{"count": len(rows)}, nil
+	}
+	return nil, fmt.Errorf("unsupported operation %v", op["op"])
+}
+
+// collectGarbage removes ports and interfaces no longer referenced, as they
+// are not in root tables.
+func (f *fakeOVSDB) collectGarbage() {
+	referenced := func(table, column string, id string) bool {
+		for _, row := range f.tables[table] {
+			if containsValue(setElements(row[column]), []interface{}{"uuid", id}) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for id := range f.tables["Port"] {
+		if !referenced("Bridge", "ports", id) {
+			delete(f.tables["Port"], id)
+		}
+	}
+	for id := range f.tables["Interface"] {
+		if !referenced("Port", "interfaces", id) {
+			delete(f.tables["Interface"], id)
+		}
+	}
+}
+
+// assignOFPorts does what ovs-vswitchd does for new interfaces: assign the
+// requested or lowest free OpenFlow port, or -1 and an error if it cannot
+// add the interface.
+func (f *fakeOVSDB) assignOFPorts() {
+	used := map[float64]bool{}
+	for _, row := range f.tables["Interface"] {
+		if ofport, ok := row["ofport"].(float64); ok {
+			used[ofport] = true
+		}
+	}
+
+	for _, row := range f.tables["Interface"] {
+		if _, ok := row["ofport"].(float64); ok {
+			continue
+		}
+		if f.failInterfaces[row["name"].(string)] {
+			row["ofport"] = float64(-1)
+			row["error"] = "could not open network device " + row["name"].(string) + " (No such device)"
+			continue
+		}
+
+		ofport, requested := row["ofport_request"].(float64)
+		if !requested || used[ofport] {
+			for ofport = 1; used[ofport]; ofport++ {
+			}
+		}
+		row["ofport"] = ofport
+		used[ofport] = true
+	}
+}
+
+func (f *fakeOVSDB) newUUID() string {
+	f.nextUUID++
+	return fmt.Sprintf("00000000-0000-0000-0000-%012d", f.nextUUID)
+}
+
+func matchesWhere(row map[string]interface{}, where interface{}) bool {
+	conditions, _ := where.([]interface{})
+	for _, c := range conditions {
+		condition := c.([]interface{})
+		value := row[condition[0].(string)]
+		switch condition[1] {
+		case "==":
+			if !reflect.DeepEqual(value, condition[2]) {
+				return false
+			}
+		case "includes":
+			for _, element := range setElements(condition[2]) {
+				if !containsValue(setElements(value), element) {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// setElements returns the elements of a set, the pairs of a map, or a single
+// atom.
+func setElements(value interface{}) []interface{} {
+	pair, ok := value.([]interface{})
+	if ok && len(pair) == 2 && (pair[0] == "set" || pair[0] == "map") {
+		return pair[1].([]interface{})
+	}
+	if value == nil {
+		return nil
+	}
+	return []interface{}{value}
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if reflect.DeepEqual(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveNamed replaces the named-uuid references of a transaction with the
+// uuids of the rows they name.
+func resolveNamed(value interface{}, named map[string]string) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		if len(v) == 2 && v[0] == "named-uuid" {
+			return []interface{}{"uuid", named[v[1].(string)]}
+		}
+		resolved := make([]interface{}, len(v))
+		for i, e := range v {
+			resolved[i] = resolveNamed(e, named)
+		}
+		return resolved
+	case map[string]interface{}:
+		resolved := map[string]interface{}{}
+		for k, e := range v {
+			resolved[k] = resolveNamed(e, named)
+		}
+		return resolved
+	}
+	return value
+}
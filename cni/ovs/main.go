@@ -4,29 +4,82 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"runtime"
+	"syscall"
 
-	"github.com/containernetworking/cni/pkg/ip"
-	"github.com/containernetworking/cni/pkg/ns"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
 )
 
 const defaultBrName = "ovs-bridge"
-const defaultOvsBinPath = "/var/vcap/packages/openvswitch/bin"
+const defaultOVSDBSocket = "/var/vcap/sys/run/openvswitch/db.sock"
+const defaultStateDir = "/var/lib/cni/gofer-ovs"
+
+// modes of wiring container ports: programming the flows of the bridge, or
+// leaving that to the Neutron OVS agent of the host
+const (
+	modeFlows        = "flows"
+	modeNeutronAgent = "neutron_agent"
+)
 
 type NetConf struct {
 	types.NetConf
-	BrName  string `json:"bridge"`
-	MTU     int    `json:"mtu"`
-	BinPath string `json:"bin_path"`
-	IP      string `json:"ip"`
-	CIDR    string `json:"cidr"`
+	BrName string `json:"bridge"`
+	MTU    int    `json:"mtu"`
+	IP     string `json:"ip"`
+	CIDR   string `json:"cidr"`
+
+	// optional IPv6 address on dual-stack networks
+	IP6   string `json:"ip6"`
+	CIDR6 string `json:"cidr6"`
+
+	// Neutron network type and segmentation ID, which is the tunnel ID
+	NetworkType    string `json:"network_type"`
+	SegmentationID int    `json:"segmentation_id"`
+
+	// Neutron subnets of the addresses, used for routes and DNS
+	Subnet  *subnetConf `json:"subnet"`
+	Subnet6 *subnetConf `json:"subnet6"`
+
+	// unix socket of ovsdb-server
+	OVSDBSocket string `json:"ovsdb_socket"`
+
+	// directory recording the bridge ports of containers
+	StateDir string `json:"state_dir"`
+
+	// OpenFlow management socket of the bridge, by default <bridge>.mgmt
+	// next to the ovsdb socket
+	OpenFlowSocket string `json:"openflow_socket"`
+
+	// "flows" (default) or "neutron_agent", which only plugs the interface
+	// into the bridge for the agent to wire up as the Neutron port
+	Mode string `json:"mode"`
+
+	// Neutron port of the container, needed by the Neutron agent. The
+	// container interface gets the MAC address of the port.
+	PortID     string `json:"port_id"`
+	MACAddress string `json:"mac_address"`
+}
+
+type subnetConf struct {
+	CIDR           string      `json:"cidr"`
+	Gateway        string      `json:"gateway"`
+	Routes         []routeConf `json:"routes"`
+	DNSNameservers []string    `json:"dns_nameservers"`
+}
+
+type routeConf struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw"`
 }
 
 func init() {
@@ -38,12 +91,23 @@ func init() {
 
 func loadNetConf(bytes []byte) (*NetConf, error) {
 	n := &NetConf{
-		BrName:  defaultBrName,
-		BinPath: defaultOvsBinPath,
+		BrName:      defaultBrName,
+		OVSDBSocket: defaultOVSDBSocket,
+		StateDir:    defaultStateDir,
+		Mode:        modeFlows,
 	}
 	if err := json.Unmarshal(bytes, n); err != nil {
 		return nil, fmt.Errorf("failed to load netconf: %v", err)
 	}
+	if err := version.ParsePrevResult(&n.NetConf); err != nil {
+		return nil, err
+	}
+	if n.Mode != modeFlows && n.Mode != modeNeutronAgent {
+		return nil, fmt.Errorf("invalid mode %q, must be %q or %q", n.Mode, modeFlows, modeNeutronAgent)
+	}
+	if n.OpenFlowSocket == "" {
+		n.OpenFlowSocket = filepath.Join(filepath.Dir(n.OVSDBSocket), n.BrName+".mgmt")
+	}
 	return n, nil
 }
 
@@ -61,19 +125,46 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return errors.New("Missing 'cidr' in delegate call to CNI plugin!")
 	}
 
+	if (n.IP6 == "") != (n.CIDR6 == "") {
+		return errors.New("Missing 'ip6' or 'cidr6' in delegate call to CNI plugin!")
+	}
+
+	// the Neutron agent takes care of the segment of the network
+	var tunnelID int
+	if n.Mode == modeNeutronAgent {
+		if n.PortID == "" || n.MACAddress == "" {
+			return errors.New("Missing 'port_id' or 'mac_address' in delegate call to CNI plugin!")
+		}
+	} else if tunnelID, err = tunnelIDOf(n); err != nil {
+		return err
+	}
+
+	hwAddr, err := hwAddrOf(n)
+	if err != nil {
+		return err
+	}
+
+	gw4, routes4, err := subnetRoutes(n.Subnet, "0.0.0.0/0")
+	if err != nil {
+		return err
+	}
+
+	gw6, routes6, err := subnetRoutes(n.Subnet6, "::/0")
+	if err != nil {
+		return err
+	}
+
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
 		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
-	vr, err := setupVeth(netns, args.IfName, n.MTU, n.IP, n.CIDR)
+	vr, err := setupVeth(netns, args.IfName, n.MTU, hwAddr, n.CIDR, n.CIDR6, append(routes4, routes6...))
 	if err != nil {
 		return err
 	}
 
-	// tunnelPort     = 10
-	// tunnelID       = 101
 	// bridgeName     = "ovs-bridge"
 	// tunnelPortName = "remote-tun"
 
@@ -84,58 +175,222 @@ func cmdAdd(args *skel.CmdArgs) error {
 		return fmt.Errorf("Invalid MAC address for container: [%s]", vr.HwAddr)
 	}
 
-	// TODO: hack for now
-	tunnelID := 101
-	ovsPortNumber := 10
-
-	err = connectToOVS(n.BinPath, n.BrName, vr.HostIfName, ovsPortNumber, containerIP, containerMAC, tunnelID)
+	ofport, err := connectToOVS(n, args.ContainerID, args.IfName, vr.HostIfName, containerIP, n.IP6, containerMAC, tunnelID)
 	if err != nil {
 		return err
 	}
 
-	result := types.Result{}
-	if n.CIDR != "" {
-		_, ipn, err := net.ParseCIDR(n.CIDR)
+	ps := portState{
+		Bridge:    n.BrName,
+		Interface: vr.HostIfName,
+		OFPort:    ofport,
+	}
+	if err = savePortState(n.StateDir, args.ContainerID, args.IfName, ps); err != nil {
+		return err
+	}
+
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		Interfaces: []*current.Interface{
+			{Name: vr.HostIfName, Mac: vr.HostHwAddr},
+			{Name: args.IfName, Mac: vr.HwAddr, Sandbox: args.Netns},
+		},
+		Routes: append(routes4, routes6...),
+	}
+
+	for _, addr := range []struct {
+		cidr string
+		gw   net.IP
+	}{
+		{n.CIDR, gw4},
+		{n.CIDR6, gw6},
+	} {
+		if addr.cidr == "" {
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(addr.cidr)
 		if err != nil {
 			return err
 		}
-		result.IP4 = &types.IPConfig{
-			IP: net.IPNet{
+		result.IPs = append(result.IPs, &current.IPConfig{
+			// the container interface
+			Interface: current.Int(1),
+			Address: net.IPNet{
 				IP:   ipn.IP,
 				Mask: ipn.Mask,
 			},
-			Routes:  vr.Routes,
-			Gateway: vr.GW,
+			Gateway: addr.gw,
+		})
+	}
+
+	for _, s := range []*subnetConf{n.Subnet, n.Subnet6} {
+		if s != nil {
+			result.DNS.Nameservers = append(result.DNS.Nameservers, s.DNSNameservers...)
 		}
 	}
 
-	return result.Print()
+	return types.PrintResult(result, n.CNIVersion)
+}
+
+// maxVNI is the largest VXLAN or Geneve network identifier, which has 24 bits
+const maxVNI = 1<<24 - 1
+
+// tunnelIDOf returns the tunnel ID of the Neutron network of a container,
+// which is the segmentation ID of VXLAN and Geneve networks.
+func tunnelIDOf(n *NetConf) (int, error) {
+	switch n.NetworkType {
+	case "vxlan", "geneve":
+	case "":
+		// gofer leaves it out when its neutron user cannot read the provider
+		// attributes of networks
+		return 0, errors.New("Missing 'network_type' in delegate call to CNI plugin! The neutron user of gofer needs to be allowed to read provider:network_type and provider:segmentation_id in flows mode")
+	default:
+		return 0, fmt.Errorf("unsupported network type %q, only vxlan and geneve networks can be tunneled", n.NetworkType)
+	}
+
+	if n.SegmentationID < 1 || n.SegmentationID > maxVNI {
+		return 0, fmt.Errorf("invalid segmentation ID %d of %s network", n.SegmentationID, n.NetworkType)
+	}
+	return n.SegmentationID, nil
+}
+
+// cmdCheck verifies that the container interface still has the MAC address
+// of its Neutron port and the addresses and routes of the result of ADD.
+func cmdCheck(args *skel.CmdArgs) error {
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if n.PrevResult == nil {
+		return errors.New("missing 'prevResult' in CHECK")
+	}
+	result, err := current.NewResultFromResult(n.PrevResult)
+	if err != nil {
+		return err
+	}
+
+	netns, err := ns.GetNS(args.Netns)
+	if err != nil {
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
+	}
+	defer netns.Close()
+
+	return netns.Do(func(ns.NetNS) error {
+		if n.MACAddress != "" {
+			hwAddr, err := hwAddrOf(n)
+			if err != nil {
+				return err
+			}
+			if err := validateHwAddr(args.IfName, hwAddr); err != nil {
+				return err
+			}
+		}
+		if err := ip.ValidateExpectedInterfaceIPs(args.IfName, result.IPs); err != nil {
+			return err
+		}
+		return ip.ValidateExpectedRoute(result.Routes)
+	})
+}
+
+// subnetRoutes returns the gateway and routes for an address in subnet s:
+// an on-link route for the subnet prefix (the address itself is a host
+// route), the default route via the gateway and the subnet's host routes.
+func subnetRoutes(s *subnetConf, defaultDst string) (net.IP, []*types.Route, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+
+	var routes []*types.Route
+	addRoute := func(dst, gw string) error {
+		_, ipn, err := net.ParseCIDR(dst)
+		if err != nil {
+			return fmt.Errorf("invalid route destination %q: %v", dst, err)
+		}
+		route := types.Route{Dst: *ipn}
+		if gw != "" {
+			route.GW = net.ParseIP(gw)
+			if route.GW == nil {
+				return fmt.Errorf("invalid route gateway %q", gw)
+			}
+		}
+		routes = append(routes, &route)
+		return nil
+	}
+
+	if err := addRoute(s.CIDR, ""); err != nil {
+		return nil, nil, err
+	}
+
+	var gw net.IP
+	if s.Gateway != "" {
+		if err := addRoute(defaultDst, s.Gateway); err != nil {
+			return nil, nil, err
+		}
+		gw = net.ParseIP(s.Gateway)
+	}
+
+	for _, r := range s.Routes {
+		if err := addRoute(r.Dst, r.GW); err != nil {
+			return nil, nil, err
+		}
+	}
+	return gw, routes, nil
 }
 
 type vethResult struct {
 	HostIfName string
+	HostHwAddr string
 	HwAddr     string
-	GW         net.IP
-	Routes     []types.Route
 }
 
-func setupVeth(netns ns.NetNS, ifName string, mtu int, ipAddr, cidr string) (vethResult, error) {
+// hwAddrFromIP derives the container MAC address from its IPv4 address, as
+// 0a:58 followed by the four bytes of the address.
+func hwAddrFromIP(ipAddr string) (string, error) {
+	ip4 := net.ParseIP(ipAddr).To4()
+	if ip4 == nil {
+		return "", fmt.Errorf("invalid IPv4 address %q", ipAddr)
+	}
+	return net.HardwareAddr(append([]byte{0x0a, 0x58}, ip4...)).String(), nil
+}
+
+// hwAddrOf returns the MAC address of the container interface, which is the
+// MAC address of the Neutron port when gofer passes one.
+func hwAddrOf(n *NetConf) (string, error) {
+	if n.MACAddress == "" {
+		return hwAddrFromIP(n.IP)
+	}
+	mac, err := net.ParseMAC(n.MACAddress)
+	if err != nil {
+		return "", fmt.Errorf("invalid 'mac_address' %q: %v", n.MACAddress, err)
+	}
+	return mac.String(), nil
+}
+
+// validateHwAddr checks that an interface has the MAC address it was given,
+// as anti-spoofing rules only let traffic from that address through.
+func validateHwAddr(ifName, hwAddr string) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	if got := link.Attrs().HardwareAddr.String(); got != hwAddr {
+		return fmt.Errorf("%q has MAC address %s, expected %s", ifName, got, hwAddr)
+	}
+	return nil
+}
+
+func setupVeth(netns ns.NetNS, ifName string, mtu int, hwAddr, cidr, cidr6 string, routes []*types.Route) (vethResult, error) {
 	var result vethResult
-	var routes []types.Route
 
 	err := netns.Do(func(hostNS ns.NetNS) error {
 		// create the veth pair in the container and move host end into host netns
-		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hostNS)
+		hostVeth, _, err := ip.SetupVeth(ifName, mtu, hwAddr, hostNS)
 		if err != nil {
 			return err
 		}
-		result.HostIfName = hostVeth.Attrs().Name
-
-		// set HW addr
-		ip4 := net.ParseIP(ipAddr)
-		if err := ip.SetHWAddrByIP(ifName, ip4, nil); err != nil {
-			return err
-		}
+		result.HostIfName = hostVeth.Name
+		result.HostHwAddr = hostVeth.HardwareAddr.String()
 
 		nl, err := netlink.LinkByName(ifName)
 		if err != nil {
@@ -153,54 +408,31 @@ func setupVeth(netns ns.NetNS, ifName string, mtu int, ipAddr, cidr string) (vet
 			return err
 		}
 
-		result.HwAddr = nl.Attrs().HardwareAddr.String()
-
-		if err = netlink.LinkSetUp(nl); err != nil {
-			return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+		if cidr6 != "" {
+			addr6, err := netlink.ParseAddr(cidr6)
+			if err != nil {
+				return err
+			}
+			// neutron already guarantees the address is unique, skip DAD
+			addr6.Flags = syscall.IFA_F_NODAD
+			if err = netlink.AddrAdd(nl, addr6); err != nil {
+				return fmt.Errorf("failed to add IPv6 address %s: %v", cidr6, err)
+			}
 		}
 
-		// TODO: ultra hack
-		_, ipn, err := net.ParseCIDR("10.0.3.0/24")
-		if err != nil {
+		if err = validateHwAddr(ifName, hwAddr); err != nil {
 			return err
 		}
-		routes = append(routes, types.Route{
-			Dst: net.IPNet{
-				IP:   ipn.IP,
-				Mask: ipn.Mask,
-			},
-		})
+		result.HwAddr = hwAddr
 
-		// _, ipn, err = net.ParseCIDR("0.0.0.0/0")
-		// if err != nil {
-		// 	return err
-		// }
-		// gwAddr := net.ParseIP("10.0.3.1")
-		// result.GW = gwAddr
-		// routes = append(routes, types.Route{
-		// 	Dst: net.IPNet{
-		// 		IP:   ipn.IP,
-		// 		Mask: ipn.Mask,
-		// 	},
-		// 	GW: gwAddr,
-		// })
-
-		// "result":
-		//    IP4:{IP:{IP:10.255.47.89 Mask:ffffff00} Gateway:10.255.47.1
-		// Routes:[
-		//    {Dst:{IP:10.255.0.0 Mask:ffff0000} GW:\\u003cnil\\u003e}
-		//    {Dst:{IP:0.0.0.0 Mask:00000000} GW:10.255.47.1}]},
-		//    DNS:{Nameservers:[] Domain: Search:[] Options:[]} }
-
-		// default via 10.255.47.1 dev eth0
-		// 10.255.0.0/16 via 10.255.47.1 dev eth0
-		// 10.255.47.0/24 dev eth0  proto kernel  scope link  src 10.255.47.71
+		if err = netlink.LinkSetUp(nl); err != nil {
+			return fmt.Errorf("failed to set %q UP: %v", ifName, err)
+		}
 
+		// routes are ordered so the on-link prefix route comes before any
+		// route via a gateway in it
 		for _, r := range routes {
 			gw := r.GW
-			// if gw == nil {
-			// 	gw = result.GW
-			// }
 			if err = ip.AddRoute(&r.Dst, gw, nl); err != nil {
 				if !os.IsExist(err) {
 					return fmt.Errorf("failed to add route '%v via %v dev %v': %v", r.Dst, gw, ifName, err)
@@ -222,102 +454,243 @@ func setupVeth(netns ns.NetNS, ifName string, mtu int, ipAddr, cidr string) (vet
 	return result, nil
 }
 
-var debug bool
+// containerExternalIDs identify the OVS interface of a container interface,
+// the same as ovs-docker does.
+func containerExternalIDs(containerID, ifName string) map[string]string {
+	return map[string]string{
+		"container_id":    containerID,
+		"container_iface": ifName,
+	}
+}
 
-func execCommand(command string, args ...string) ([]byte, error) {
-	if debug {
-		fmt.Printf("%s", command)
-		for _, arg := range args {
-			fmt.Printf(" %s", arg)
-		}
-		fmt.Printf("\n")
+// neutronAgentExternalIDs identify the Neutron port of an interface to the
+// Neutron OVS agent, the same as Nova does for the interfaces of instances.
+func neutronAgentExternalIDs(portID, mac string) map[string]string {
+	return map[string]string{
+		"iface-id":     portID,
+		"attached-mac": mac,
+		"iface-status": "active",
 	}
-	return exec.Command(command, args...).CombinedOutput()
 }
 
-func connectToOVS(path, ovsBridgeName, interfaceName string, ovsPortNumber int, containerIP, containerMAC string, tunnelID int) error {
-	cmd := fmt.Sprintf("%s/ovs-vsctl add-port %s %s -- set interface %s ofport_request=%d", path, ovsBridgeName, interfaceName, interfaceName, ovsPortNumber)
-	output, err := execCommand("bash", "-c", cmd)
+// connectToOVS connects the host end of the veth to the bridge and sets it
+// up, returning the OpenFlow port OVS assigned to it.
+func connectToOVS(n *NetConf, containerID, containerIfName, interfaceName string, containerIP, containerIP6, containerMAC string, tunnelID int) (int, error) {
+	ofport, err := addToOVS(n, containerID, containerIfName, interfaceName, containerIP, containerIP6, containerMAC, tunnelID)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return 0, err
 	}
 
-	err = addFlow(path, containerIP, containerMAC, ovsBridgeName, ovsPortNumber, tunnelID)
+	link, err := netlink.LinkByName(interfaceName)
 	if err != nil {
-		return fmt.Errorf("error adding flow using ip [%s] mac [%s] port [%d] tun [%d] error: %s\n", containerIP, containerMAC, ovsPortNumber, tunnelID, err)
+		return 0, fmt.Errorf("failed to lookup %q: %v", interfaceName, err)
+	}
+	if err = netlink.LinkSetUp(link); err != nil {
+		return 0, fmt.Errorf("failed to set %q UP: %v", interfaceName, err)
 	}
 
-	anotherFlow := fmt.Sprintf("%s/ovs-ofctl add-flow %s 'table=0,in_port=%d,actions=set_field:%d->tun_id,resubmit(,1)'", path, ovsBridgeName, ovsPortNumber, tunnelID)
-	output, err = execCommand("bash", "-c", anotherFlow)
+	return ofport, nil
+}
+
+// addToOVS adds an interface to the bridge and installs the flows of the
+// container for the OpenFlow port OVS assigned to it, unless the Neutron
+// agent wires the port. A failed ADD leaves the port to DEL, which finds it
+// by its external_ids.
+func addToOVS(n *NetConf, containerID, containerIfName, interfaceName string, containerIP, containerIP6, containerMAC string, tunnelID int) (int, error) {
+	ip4 := net.ParseIP(containerIP)
+	if ip4 == nil {
+		return 0, fmt.Errorf("invalid container IP %q", containerIP)
+	}
+	var ip6 net.IP
+	if containerIP6 != "" {
+		if ip6 = net.ParseIP(containerIP6); ip6 == nil {
+			return 0, fmt.Errorf("invalid container IPv6 address %q", containerIP6)
+		}
+	}
+	mac, err := net.ParseMAC(containerMAC)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return 0, fmt.Errorf("invalid container MAC %q: %v", containerMAC, err)
 	}
 
-	ifUpCommand := fmt.Sprintf("ifconfig %s up", interfaceName)
-	output, err = execCommand("bash", "-c", ifUpCommand)
+	db, err := dialOVSDB(n.OVSDBSocket)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return 0, err
 	}
+	defer db.Close()
 
-	return nil
+	externalIDs := containerExternalIDs(containerID, containerIfName)
+	if n.Mode == modeNeutronAgent {
+		for k, v := range neutronAgentExternalIDs(n.PortID, mac.String()) {
+			externalIDs[k] = v
+		}
+	}
+
+	err = db.addPort(n.BrName, interfaceName, map[string]interface{}{
+		"external_ids": ovsdbMap(externalIDs),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	ovsPortNumber, err := db.ofport(interfaceName)
+	if err != nil {
+		return 0, err
+	}
+
+	if n.Mode == modeNeutronAgent {
+		return ovsPortNumber, nil
+	}
+
+	of, err := dialOpenFlow(n.OpenFlowSocket)
+	if err != nil {
+		return 0, err
+	}
+	defer of.Close()
+
+	flows := containerFlows(containerCookie(containerID), uint32(ovsPortNumber), uint64(tunnelID), ip4, ip6, mac)
+	if err = of.bundle(flows...); err != nil {
+		return 0, fmt.Errorf("error adding flows using ip [%s] mac [%s] port [%d] tun [%d] error: %s", containerIP, containerMAC, ovsPortNumber, tunnelID, err)
+	}
+
+	return ovsPortNumber, nil
 }
 
-func addFlow(path, containerIP, containerMAC, bridgeName string, tunnelPort, tunnelID int) error {
-	addMacFlow := fmt.Sprintf("%s/ovs-ofctl add-flow %s table=1,tun_id=%d,dl_dst=%s,actions=output:%d", path, bridgeName, tunnelID, containerMAC, tunnelPort)
-	output, err := execCommand("bash", "-c", addMacFlow)
+// portState records the bridge port of a container interface.
+type portState struct {
+	Bridge    string `json:"bridge"`
+	Interface string `json:"interface"`
+	OFPort    int    `json:"ofport"`
+}
+
+func portStatePath(stateDir, containerID, ifName string) string {
+	return filepath.Join(stateDir, containerID+"-"+ifName)
+}
+
+func savePortState(stateDir, containerID, ifName string, ps portState) error {
+	bytes, err := json.Marshal(ps)
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
 	}
+	return ioutil.WriteFile(portStatePath(stateDir, containerID, ifName), bytes, 0644)
+}
 
-	addIPFlow := fmt.Sprintf("%s/ovs-ofctl add-flow %s table=1,tun_id=%d,arp,nw_dst=%s,actions=output:%d", path, bridgeName, tunnelID, containerIP, tunnelPort)
-	output, err = execCommand("bash", "-c", addIPFlow)
+func loadPortState(stateDir, containerID, ifName string) (portState, error) {
+	var ps portState
+	bytes, err := ioutil.ReadFile(portStatePath(stateDir, containerID, ifName))
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return ps, err
 	}
+	err = json.Unmarshal(bytes, &ps)
+	return ps, err
+}
 
+// removeFromOVS deletes the flows and the bridge port of a container
+// interface. Flows and ports that are gone already are ignored.
+func removeFromOVS(n *NetConf, containerID, containerIfName string) error {
+	// the flows go first, so no traffic is sent to a port about to be gone
+	if n.Mode != modeNeutronAgent {
+		if err := removeFlows(n, containerID); err != nil {
+			return err
+		}
+	}
+
+	db, err := dialOVSDB(n.OVSDBSocket)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// containers added before the port was recorded are found by the
+	// external_ids of their interface
+	var names []string
+	ps, err := loadPortState(n.StateDir, containerID, containerIfName)
+	switch {
+	case err == nil:
+		names = []string{ps.Interface}
+	case os.IsNotExist(err):
+		names, err = db.interfacesByExternalIDs(containerExternalIDs(containerID, containerIfName))
+		if err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	for _, name := range names {
+		if err := db.deletePort(n.BrName, name); err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(portStatePath(n.StateDir, containerID, containerIfName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
-func removeFromOVS(path, ovsBridgeName, interfaceName string) error {
-	cmd := fmt.Sprintf("%s/ovs-vsctl del-port %s %s", path, ovsBridgeName, interfaceName)
-	output, err := execCommand("bash", "-c", cmd)
+func removeFlows(n *NetConf, containerID string) error {
+	of, err := dialOpenFlow(n.OpenFlowSocket)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		// no switch serves the bridge, so it has no flows left either
+		return nil
+	}
 	if err != nil {
-		return fmt.Errorf("%s: %s", err, output)
+		return err
 	}
+	defer of.Close()
 
-	// TODO: delete flows?
-
+	if err = of.bundle(deleteFlows(containerCookie(containerID))); err != nil {
+		return fmt.Errorf("error deleting flows of container %s: %v", containerID, err)
+	}
 	return nil
 }
 
 func cmdDel(args *skel.CmdArgs) error {
-	// n, err := loadNetConf(args.StdinData)
-	// if err != nil {
-	// 	return err
-	// }
+	n, err := loadNetConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	if err = removeFromOVS(n, args.ContainerID, args.IfName); err != nil {
+		return err
+	}
 
 	if args.Netns == "" {
 		return nil
 	}
 
-	// err = removeFromOVS(n.BinPath, n.BrName, hostIfName)
-	// if err != nil {
-	// 	return err
-	// }
-
-	// var ipn *net.IPNet
-	// err := ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-	// 	var err error
-	// 	ipn, err = ip.DelLinkByNameAddr(args.IfName, netlink.FAMILY_V4)
-	// 	return err
-	// })
+	// deleting the container end of the veth deletes the host end too
+	err = ns.WithNetNSPath(args.Netns, func(ns.NetNS) error {
+		if err := ip.DelLinkByName(args.IfName); err != nil && err != ip.ErrLinkNotFound {
+			return err
+		}
+		return nil
+	})
+	if _, ok := err.(ns.NSPathNotExistErr); ok {
+		return nil
+	}
+	return err
+}
 
-	// if err != nil {
-	// 	return err
-	// }
-	return nil
+// commands the plugin runs for operators next to being a CNI plugin
+var commands = map[string]func(args []string) error{
+	"tunnels": runTunnels,
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdDel, version.Legacy)
+	if len(os.Args) > 1 {
+		if run, ok := commands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "ovs %s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "ovs: connects containers to an Open vSwitch bridge")
 }
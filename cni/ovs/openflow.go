@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"time"
+)
+
+const openflowTimeout = 10 * time.Second
+
+// OpenFlow 1.3 message types, see section 7 of the specification
+const (
+	ofpVersion = 0x04
+
+	ofptHello        = 0
+	ofptError        = 1
+	ofptEchoRequest  = 2
+	ofptEchoReply    = 3
+	ofptExperimenter = 4
+	ofptFlowMod      = 14
+)
+
+// bundles are the ONF extension 230 in OpenFlow 1.3, as supported by Open
+// vSwitch, and part of OpenFlow 1.4 proper
+const (
+	onfExperimenterID = 0x4f4e4600
+
+	onftBundleControl    = 2300
+	onftBundleAddMessage = 2301
+
+	bundleOpenRequest   = 0
+	bundleOpenReply     = 1
+	bundleCommitRequest = 4
+	bundleCommitReply   = 5
+
+	bundleAtomic = 1
+)
+
+const (
+	ofpfcAdd    = 0
+	ofpfcDelete = 3
+
+	ofpttAll    = 0xff
+	ofppAny     = 0xffffffff
+	ofpgAny     = 0xffffffff
+	ofpNoBuffer = 0xffffffff
+
+	defaultFlowPriority = 0x8000
+)
+
+// OXM fields of the OpenFlow basic class
+const (
+	oxmInPort        = 0
+	oxmEthDst        = 3
+	oxmEthType       = 5
+	oxmIPProto       = 10
+	oxmARPTPA        = 22
+	oxmICMPv6Type    = 29
+	oxmIPv6NDTarget  = 31
+	oxmTunnelID      = 38
+	oxmClassOpenFlow = 0x8000
+)
+
+const (
+	ofpitGotoTable    = 1
+	ofpitApplyActions = 4
+
+	ofpatOutput   = 0
+	ofpatSetField = 25
+)
+
+// openflowConn is a connection to the management socket of a bridge, on
+// which ovs-vswitchd accepts OpenFlow without a controller configured.
+type openflowConn struct {
+	conn net.Conn
+	xid  uint32
+}
+
+func dialOpenFlow(socket string) (*openflowConn, error) {
+	conn, err := net.DialTimeout("unix", socket, openflowTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to openflow socket %s: %w", socket, err)
+	}
+	c := &openflowConn{conn: conn}
+	conn.SetDeadline(time.Now().Add(openflowTimeout))
+
+	if err := c.send(ofptHello, c.nextXID(), nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	version, msgType, _, _, err := c.recv()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msgType != ofptHello || version < ofpVersion {
+		conn.Close()
+		return nil, fmt.Errorf("openflow switch at %s does not support OpenFlow 1.3", socket)
+	}
+	return c, nil
+}
+
+func (c *openflowConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *openflowConn) nextXID() uint32 {
+	c.xid++
+	return c.xid
+}
+
+func openflowMessage(msgType uint8, xid uint32, body []byte) []byte {
+	msg := make([]byte, 8, 8+len(body))
+	msg[0] = ofpVersion
+	msg[1] = msgType
+	binary.BigEndian.PutUint16(msg[2:], uint16(8+len(body)))
+	binary.BigEndian.PutUint32(msg[4:], xid)
+	return append(msg, body...)
+}
+
+func (c *openflowConn) send(msgType uint8, xid uint32, body []byte) error {
+	if _, err := c.conn.Write(openflowMessage(msgType, xid, body)); err != nil {
+		return fmt.Errorf("failed to send openflow message: %v", err)
+	}
+	return nil
+}
+
+func (c *openflowConn) recv() (version, msgType uint8, xid uint32, body []byte, err error) {
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(c.conn, header); err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("failed to receive openflow message: %v", err)
+	}
+	length := binary.BigEndian.Uint16(header[2:])
+	if length < 8 {
+		return 0, 0, 0, nil, fmt.Errorf("invalid openflow message length %d", length)
+	}
+	body = make([]byte, length-8)
+	if _, err = io.ReadFull(c.conn, body); err != nil {
+		return 0, 0, 0, nil, fmt.Errorf("failed to receive openflow message: %v", err)
+	}
+	return header[0], header[1], binary.BigEndian.Uint32(header[4:]), body, nil
+}
+
+// await reads messages until the bundle control reply of xid, answering
+// echo requests and failing on errors for any of our messages.
+func (c *openflowConn) await(xid uint32, replyType uint16) error {
+	for {
+		_, msgType, got, body, err := c.recv()
+		if err != nil {
+			return err
+		}
+
+		switch msgType {
+		case ofptEchoRequest:
+			if err := c.send(ofptEchoReply, got, body); err != nil {
+				return err
+			}
+		case ofptError:
+			if len(body) < 4 {
+				return fmt.Errorf("openflow error for message %d", got)
+			}
+			return fmt.Errorf("openflow error for message %d: type %d code %d",
+				got, binary.BigEndian.Uint16(body), binary.BigEndian.Uint16(body[2:]))
+		case ofptExperimenter:
+			if got != xid || len(body) < 14 {
+				continue
+			}
+			if t := binary.BigEndian.Uint16(body[12:]); t != replyType {
+				return fmt.Errorf("unexpected bundle control reply type %d", t)
+			}
+			return nil
+		}
+	}
+}
+
+func bundleControl(bundleID uint32, controlType uint16) []byte {
+	body := make([]byte, 16)
+	binary.BigEndian.PutUint32(body, onfExperimenterID)
+	binary.BigEndian.PutUint32(body[4:], onftBundleControl)
+	binary.BigEndian.PutUint32(body[8:], bundleID)
+	binary.BigEndian.PutUint16(body[12:], controlType)
+	binary.BigEndian.PutUint16(body[14:], bundleAtomic)
+	return body
+}
+
+// bundle applies flow mods atomically: the switch either commits all of them
+// or, if it rejects any, none.
+func (c *openflowConn) bundle(mods ...flowMod) error {
+	c.conn.SetDeadline(time.Now().Add(openflowTimeout))
+
+	bundleID := c.nextXID()
+	xid := c.nextXID()
+	if err := c.send(ofptExperimenter, xid, bundleControl(bundleID, bundleOpenRequest)); err != nil {
+		return err
+	}
+	if err := c.await(xid, bundleOpenReply); err != nil {
+		return fmt.Errorf("failed to open bundle: %v", err)
+	}
+
+	for _, mod := range mods {
+		xid := c.nextXID()
+		body := make([]byte, 16)
+		binary.BigEndian.PutUint32(body, onfExperimenterID)
+		binary.BigEndian.PutUint32(body[4:], onftBundleAddMessage)
+		binary.BigEndian.PutUint32(body[8:], bundleID)
+		binary.BigEndian.PutUint16(body[14:], bundleAtomic)
+		// the bundled message has the xid of the one adding it
+		body = append(body, openflowMessage(ofptFlowMod, xid, mod.marshal())...)
+		if err := c.send(ofptExperimenter, xid, body); err != nil {
+			return err
+		}
+	}
+
+	xid = c.nextXID()
+	if err := c.send(ofptExperimenter, xid, bundleControl(bundleID, bundleCommitRequest)); err != nil {
+		return err
+	}
+	if err := c.await(xid, bundleCommitReply); err != nil {
+		return fmt.Errorf("failed to commit bundle: %v", err)
+	}
+	return nil
+}
+
+// oxmField is a field of a match or set_field action.
+type oxmField struct {
+	field uint8
+	value []byte
+}
+
+func (f oxmField) marshal() []byte {
+	b := make([]byte, 4, 4+len(f.value))
+	binary.BigEndian.PutUint16(b, oxmClassOpenFlow)
+	b[2] = f.field << 1
+	b[3] = uint8(len(f.value))
+	return append(b, f.value...)
+}
+
+func uint16Bytes(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func uint64Bytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func matchInPort(port uint32) oxmField          { return oxmField{oxmInPort, uint32Bytes(port)} }
+func matchTunnelID(id uint64) oxmField          { return oxmField{oxmTunnelID, uint64Bytes(id)} }
+func matchEthType(t uint16) oxmField            { return oxmField{oxmEthType, uint16Bytes(t)} }
+func matchIPProto(p uint8) oxmField             { return oxmField{oxmIPProto, []byte{p}} }
+func matchICMPv6Type(t uint8) oxmField          { return oxmField{oxmICMPv6Type, []byte{t}} }
+func matchARPTPA(ip net.IP) oxmField            { return oxmField{oxmARPTPA, []byte(ip.To4())} }
+func matchNDTarget(ip net.IP) oxmField          { return oxmField{oxmIPv6NDTarget, []byte(ip.To16())} }
+func matchEthDst(mac net.HardwareAddr) oxmField { return oxmField{oxmEthDst, []byte(mac)} }
+
+// pad8 pads b with zeros to a multiple of 8 bytes.
+func pad8(b []byte) []byte {
+	if rem := len(b) % 8; rem != 0 {
+		b = append(b, make([]byte, 8-rem)...)
+	}
+	return b
+}
+
+func actionOutput(port uint32) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint16(b, ofpatOutput)
+	binary.BigEndian.PutUint16(b[2:], 16)
+	binary.BigEndian.PutUint32(b[4:], port)
+	return b
+}
+
+func actionSetTunnelID(id uint64) []byte {
+	b := append(make([]byte, 4), matchTunnelID(id).marshal()...)
+	b = pad8(b)
+	binary.BigEndian.PutUint16(b, ofpatSetField)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func applyActions(actions ...[]byte) []byte {
+	b := make([]byte, 8)
+	for _, a := range actions {
+		b = append(b, a...)
+	}
+	binary.BigEndian.PutUint16(b, ofpitApplyActions)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b
+}
+
+func gotoTable(table uint8) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, ofpitGotoTable)
+	binary.BigEndian.PutUint16(b[2:], 8)
+	b[4] = table
+	return b
+}
+
+// flowMod is an OpenFlow 1.3 flow table modification.
+type flowMod struct {
+	command      uint8
+	table        uint8
+	priority     uint16
+	cookie       uint64
+	cookieMask   uint64
+	match        []oxmField
+	instructions [][]byte
+}
+
+func (m flowMod) marshal() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, struct {
+		Cookie      uint64
+		CookieMask  uint64
+		TableID     uint8
+		Command     uint8
+		IdleTimeout uint16
+		HardTimeout uint16
+		Priority    uint16
+		BufferID    uint32
+		OutPort     uint32
+		OutGroup    uint32
+		Flags       uint16
+		Pad         [2]byte
+	}{
+		Cookie:     m.cookie,
+		CookieMask: m.cookieMask,
+		TableID:    m.table,
+		Command:    m.command,
+		Priority:   m.priority,
+		BufferID:   ofpNoBuffer,
+		OutPort:    ofppAny,
+		OutGroup:   ofpgAny,
+	})
+
+	match := make([]byte, 4)
+	for _, f := range m.match {
+		match = append(match, f.marshal()...)
+	}
+	binary.BigEndian.PutUint16(match, 1) // OFPMT_OXM
+	binary.BigEndian.PutUint16(match[2:], uint16(len(match)))
+	b.Write(pad8(match))
+
+	for _, i := range m.instructions {
+		b.Write(i)
+	}
+	return b.Bytes()
+}
+
+// containerCookie identifies the flows of a container, so they can be
+// deleted together.
+func containerCookie(containerID string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(containerID))
+	return h.Sum64()
+}
+
+// deleteFlows returns a flow mod deleting the flows with a cookie from all
+// tables. Deleting flows that do not exist is not an error.
+func deleteFlows(cookie uint64) flowMod {
+	return flowMod{
+		command:    ofpfcDelete,
+		table:      ofpttAll,
+		cookie:     cookie,
+		cookieMask: ^uint64(0),
+	}
+}
+
+// containerFlows returns the flows connecting a container port to its
+// tunnel: table 0 tags traffic from the port with the tunnel ID, table 1
+// delivers traffic of the tunnel addressed to the container to the port.
+func containerFlows(cookie uint64, port uint32, tunnelID uint64, containerIP, containerIP6 net.IP, containerMAC net.HardwareAddr) []flowMod {
+	flows := []flowMod{{
+		command:  ofpfcAdd,
+		table:    0,
+		priority: defaultFlowPriority,
+		cookie:   cookie,
+		match:    []oxmField{matchInPort(port)},
+		instructions: [][]byte{
+			applyActions(actionSetTunnelID(tunnelID)),
+			gotoTable(1),
+		},
+	}}
+	return append(flows, deliveryFlows(cookie, port, tunnelID, containerIP, containerIP6, containerMAC)...)
+}
+
+// deliveryFlows returns the table 1 flows sending traffic of a tunnel for a
+// container to port, which is the container's own port or the tunnel to the
+// host it is on.
+func deliveryFlows(cookie uint64, port uint32, tunnelID uint64, containerIP, containerIP6 net.IP, containerMAC net.HardwareAddr) []flowMod {
+	flow := func(match ...oxmField) flowMod {
+		return flowMod{
+			command:      ofpfcAdd,
+			table:        1,
+			priority:     defaultFlowPriority,
+			cookie:       cookie,
+			match:        match,
+			instructions: [][]byte{applyActions(actionOutput(port))},
+		}
+	}
+
+	flows := []flowMod{
+		flow(matchTunnelID(tunnelID), matchEthDst(containerMAC)),
+		flow(matchTunnelID(tunnelID), matchEthType(0x0806), matchARPTPA(containerIP)),
+	}
+	if containerIP6 != nil {
+		// neighbor solicitations are multicast, so match on their target
+		flows = append(flows, flow(
+			matchTunnelID(tunnelID),
+			matchEthType(0x86dd),
+			matchIPProto(58),
+			matchICMPv6Type(135),
+			matchNDTarget(containerIP6),
+		))
+	}
+	return flows
+}
@@ -1,7 +1,20 @@
-package main_test
+package main
 
 import (
-	. "github.com/markstgodard/gofer/cni/ovs"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/markstgodard/gofer/cni/peerlist"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -9,4 +22,660 @@ import (
 
 var _ = Describe("Ovs", func() {
 
+	Describe("ovsdbClient", func() {
+		var (
+			dir    string
+			server *fakeOVSDB
+			client *ovsdbClient
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "ovsdb")
+			Expect(err).NotTo(HaveOccurred())
+
+			server, err = newFakeOVSDB(filepath.Join(dir, "db.sock"), "br-int")
+			Expect(err).NotTo(HaveOccurred())
+
+			client, err = dialOVSDB(filepath.Join(dir, "db.sock"))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			client.Close()
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		portNames := func() []interface{} {
+			var names []interface{}
+			for _, row := range server.rows("Port") {
+				names = append(names, row["name"])
+			}
+			return names
+		}
+
+		It("adds a port and its interface to the bridge in one transaction", func() {
+			err := client.addPort("br-int", "s-010255096003", map[string]interface{}{"ofport_request": 10})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(server.transactions).To(Equal(1))
+
+			interfaces := server.rows("Interface")
+			Expect(interfaces).To(HaveLen(1))
+			Expect(interfaces[0]["name"]).To(Equal("s-010255096003"))
+			Expect(interfaces[0]["ofport_request"]).To(BeEquivalentTo(10))
+
+			ports := server.rows("Port")
+			Expect(ports).To(HaveLen(1))
+			Expect(ports[0]["interfaces"]).To(Equal(interfaces[0]["_uuid"]))
+
+			bridge := server.rows("Bridge")[0]
+			Expect(bridge["ports"]).To(Equal([]interface{}{"set", []interface{}{ports[0]["_uuid"]}}))
+		})
+
+		It("leaves nothing behind when the bridge does not exist", func() {
+			err := client.addPort("br-missing", "s-010255096003", nil)
+			Expect(err).To(MatchError(ContainSubstring("failed to add port s-010255096003 to bridge br-missing")))
+
+			Expect(server.rows("Interface")).To(BeEmpty())
+			Expect(server.rows("Port")).To(BeEmpty())
+		})
+
+		It("passes names verbatim", func() {
+			name := "s-1; rm -rf / $(reboot)"
+			Expect(client.addPort("br-int", name, nil)).To(Succeed())
+			Expect(portNames()).To(ConsistOf(name))
+
+			Expect(client.deletePort("br-int", name)).To(Succeed())
+			Expect(portNames()).To(BeEmpty())
+		})
+
+		It("deletes a port and its interface", func() {
+			Expect(client.addPort("br-int", "s-010255096003", nil)).To(Succeed())
+			Expect(client.addPort("br-int", "s-010255096004", nil)).To(Succeed())
+
+			Expect(client.deletePort("br-int", "s-010255096003")).To(Succeed())
+
+			Expect(portNames()).To(ConsistOf("s-010255096004"))
+			Expect(server.rows("Interface")).To(HaveLen(1))
+			Expect(server.rows("Bridge")[0]["ports"]).To(Equal([]interface{}{"set", []interface{}{server.rows("Port")[0]["_uuid"]}}))
+		})
+
+		It("ignores ports that are gone already", func() {
+			Expect(client.deletePort("br-int", "s-010255096003")).To(Succeed())
+		})
+
+		It("answers echo requests of the server", func() {
+			Expect(client.addPort("br-int", "s-010255096003", nil)).To(Succeed())
+			Eventually(func() int {
+				server.mu.Lock()
+				defer server.mu.Unlock()
+				return server.echoReplies
+			}, time.Second).Should(Equal(1))
+		})
+
+		It("finds interfaces by their external_ids", func() {
+			Expect(client.addPort("br-int", "s-010255096003", map[string]interface{}{
+				"external_ids": ovsdbMap(containerExternalIDs("container-1", "eth0")),
+			})).To(Succeed())
+			Expect(client.addPort("br-int", "s-010255096004", map[string]interface{}{
+				"external_ids": ovsdbMap(containerExternalIDs("container-2", "eth0")),
+			})).To(Succeed())
+
+			names, err := client.interfacesByExternalIDs(containerExternalIDs("container-2", "eth0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(ConsistOf("s-010255096004"))
+
+			names, err = client.interfacesByExternalIDs(containerExternalIDs("container-3", "eth0"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(names).To(BeEmpty())
+		})
+	})
+
+	Describe("openflowConn", func() {
+		var (
+			dir    string
+			sw     *fakeSwitch
+			client *openflowConn
+			flows  []flowMod
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "openflow")
+			Expect(err).NotTo(HaveOccurred())
+
+			sw, err = newFakeSwitch(filepath.Join(dir, "br-int.mgmt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			client, err = dialOpenFlow(filepath.Join(dir, "br-int.mgmt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			mac, _ := net.ParseMAC("0a:58:0a:ff:60:03")
+			flows = containerFlows(0x1234, 10, 101, net.ParseIP("10.255.96.3"), nil, mac)
+		})
+
+		AfterEach(func() {
+			client.Close()
+			sw.Close()
+			os.RemoveAll(dir)
+		})
+
+		describeInstalled := func() []string {
+			var flows []string
+			for _, mod := range sw.installed() {
+				flows = append(flows, describeFlowMod(mod))
+			}
+			return flows
+		}
+
+		It("installs the flows of a container as one bundle", func() {
+			Expect(client.bundle(flows...)).To(Succeed())
+
+			Expect(sw.bundles).To(Equal(1))
+			Expect(describeInstalled()).To(Equal([]string{
+				"cookie=0x1234,table=0,priority=32768,in_port=10 actions=set_field:101->tun_id,goto_table:1",
+				"cookie=0x1234,table=1,priority=32768,tun_id=101,dl_dst=0a:58:0a:ff:60:03 actions=output:10",
+				"cookie=0x1234,table=1,priority=32768,tun_id=101,dl_type=0x0806,arp_tpa=10.255.96.3 actions=output:10",
+			}))
+		})
+
+		It("sends flow mods in the OpenFlow 1.3 wire format", func() {
+			Expect(client.bundle(flows[0])).To(Succeed())
+
+			Expect(hex.EncodeToString(sw.installed()[0])).To(Equal("" +
+				"0000000000001234" + "0000000000000000" + // cookie, cookie mask
+				"00" + "00" + "0000" + "0000" + "8000" + // table, add, timeouts, priority
+				"ffffffff" + "ffffffff" + "ffffffff" + "0000" + "0000" + // buffer, out port and group, flags
+				"0001000c" + "80000004" + "0000000a" + "00000000" + // in_port=10
+				"00040018" + "00000000" + // apply actions
+				"00190010" + "80004c08" + "0000000000000065" + // set_field:101->tun_id
+				"00010008" + "01000000", // goto_table:1
+			))
+		})
+
+		It("matches neighbor solicitations for the IPv6 address", func() {
+			mac, _ := net.ParseMAC("0a:58:0a:ff:60:03")
+			flows = containerFlows(0x1234, 10, 101, net.ParseIP("10.255.96.3"), net.ParseIP("fd00::3"), mac)
+			Expect(client.bundle(flows...)).To(Succeed())
+
+			Expect(describeInstalled()).To(ContainElement(
+				"cookie=0x1234,table=1,priority=32768,tun_id=101,dl_type=0x86dd,nw_proto=58,icmp_type=135,nd_target=fd00::3 actions=output:10",
+			))
+		})
+
+		It("installs none of the flows when the switch rejects one", func() {
+			table := uint8(1)
+			sw.mu.Lock()
+			sw.rejectTable = &table
+			sw.mu.Unlock()
+
+			err := client.bundle(flows...)
+			Expect(err).To(MatchError(ContainSubstring("openflow error")))
+			Expect(sw.installed()).To(BeEmpty())
+		})
+
+		It("answers echo requests of the switch", func() {
+			Expect(client.bundle(flows...)).To(Succeed())
+
+			sw.mu.Lock()
+			defer sw.mu.Unlock()
+			Expect(sw.echoReplies).To(Equal(1))
+		})
+
+		It("deletes the flows of a container by cookie", func() {
+			mac, _ := net.ParseMAC("0a:58:0a:ff:60:04")
+			others := containerFlows(0x5678, 11, 101, net.ParseIP("10.255.96.4"), nil, mac)
+			Expect(client.bundle(append(flows, others...)...)).To(Succeed())
+
+			Expect(client.bundle(deleteFlows(0x1234))).To(Succeed())
+			Expect(describeInstalled()).To(HaveLen(3))
+			for _, flow := range describeInstalled() {
+				Expect(flow).To(HavePrefix("cookie=0x5678,"))
+			}
+
+			// the flows are gone already
+			Expect(client.bundle(deleteFlows(0x1234))).To(Succeed())
+			Expect(describeInstalled()).To(HaveLen(3))
+		})
+
+		It("uses a distinct cookie per container", func() {
+			Expect(containerCookie("container-1")).To(Equal(containerCookie("container-1")))
+			Expect(containerCookie("container-1")).NotTo(Equal(containerCookie("container-2")))
+		})
+	})
+
+	Describe("adding to and removing from OVS", func() {
+		var (
+			dir    string
+			server *fakeOVSDB
+			sw     *fakeSwitch
+			n      *NetConf
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "ovs")
+			Expect(err).NotTo(HaveOccurred())
+
+			server, err = newFakeOVSDB(filepath.Join(dir, "db.sock"), "br-int")
+			Expect(err).NotTo(HaveOccurred())
+			sw, err = newFakeSwitch(filepath.Join(dir, "br-int.mgmt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err = loadNetConf([]byte(fmt.Sprintf(`{"bridge": "br-int", "ovsdb_socket": "%s", "state_dir": "%s"}`,
+				filepath.Join(dir, "db.sock"), filepath.Join(dir, "state"))))
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			sw.Close()
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		portNames := func() []interface{} {
+			var names []interface{}
+			for _, row := range server.rows("Port") {
+				names = append(names, row["name"])
+			}
+			return names
+		}
+
+		flowsOf := func(containerID string) []string {
+			var flows []string
+			for _, mod := range sw.installed() {
+				flow := describeFlowMod(mod)
+				if strings.HasPrefix(flow, fmt.Sprintf("cookie=%#x,", containerCookie(containerID))) {
+					flows = append(flows, flow)
+				}
+			}
+			return flows
+		}
+
+		add := func(i int) int {
+			ofport, err := addToOVS(n, fmt.Sprintf("container-%d", i), "eth0", fmt.Sprintf("s-01025509600%d", i),
+				fmt.Sprintf("10.255.96.%d", i), "", fmt.Sprintf("0a:58:0a:ff:60:0%d", i), 1001)
+			Expect(err).NotTo(HaveOccurred())
+			return ofport
+		}
+
+		Describe("addToOVS", func() {
+			It("uses the OpenFlow port OVS assigns in the flows", func() {
+				Expect(add(1)).To(Equal(1))
+				Expect(add(2)).To(Equal(2))
+
+				Expect(flowsOf("container-2")).To(ConsistOf(
+					MatchRegexp(`table=0,.*,in_port=2 actions=set_field:1001->tun_id,goto_table:1`),
+					MatchRegexp(`table=1,.*,tun_id=1001,dl_dst=0a:58:0a:ff:60:02 actions=output:2`),
+					MatchRegexp(`table=1,.*,tun_id=1001,dl_type=0x0806,arp_tpa=10.255.96.2 actions=output:2`),
+				))
+			})
+
+			It("tags the interface with the container", func() {
+				add(1)
+
+				interfaces := server.rows("Interface")
+				Expect(interfaces).To(HaveLen(1))
+				Expect(interfaces[0]["external_ids"]).To(Equal(ovsdbMap(containerExternalIDs("container-1", "eth0"))))
+			})
+
+			It("fails when OVS cannot add the interface", func() {
+				server.mu.Lock()
+				server.failInterfaces = map[string]bool{"s-010255096001": true}
+				server.mu.Unlock()
+
+				_, err := addToOVS(n, "container-1", "eth0", "s-010255096001", "10.255.96.1", "", "0a:58:0a:ff:60:01", 1001)
+				Expect(err).To(MatchError(ContainSubstring("could not open network device s-010255096001")))
+				Expect(sw.installed()).To(BeEmpty())
+			})
+
+			Context("when the Neutron agent wires the port", func() {
+				BeforeEach(func() {
+					n.Mode = modeNeutronAgent
+					n.PortID = "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db"
+					n.MACAddress = "fa:16:3e:a6:50:c1"
+				})
+
+				It("tags the interface with the Neutron port", func() {
+					_, err := addToOVS(n, "container-1", "eth0", "s-010255096001", "10.255.96.1", "", "FA:16:3E:A6:50:C1", 0)
+					Expect(err).NotTo(HaveOccurred())
+
+					interfaces := server.rows("Interface")
+					Expect(interfaces).To(HaveLen(1))
+					Expect(ovsdbMapValue(interfaces[0]["external_ids"])).To(Equal(map[string]string{
+						"container_id":    "container-1",
+						"container_iface": "eth0",
+						"iface-id":        "ebe69f1e-bc26-4db5-bed0-c0afb4afe3db",
+						"attached-mac":    "fa:16:3e:a6:50:c1",
+						"iface-status":    "active",
+					}))
+				})
+
+				It("installs no flows", func() {
+					add(1)
+					Expect(sw.installed()).To(BeEmpty())
+
+					Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+					Expect(portNames()).To(BeEmpty())
+					Expect(sw.bundles).To(BeZero())
+				})
+			})
+		})
+
+		Describe("removeFromOVS", func() {
+			BeforeEach(func() {
+				for i := 1; i <= 2; i++ {
+					ofport := add(i)
+					Expect(savePortState(n.StateDir, fmt.Sprintf("container-%d", i), "eth0", portState{
+						Bridge:    "br-int",
+						Interface: fmt.Sprintf("s-01025509600%d", i),
+						OFPort:    ofport,
+					})).To(Succeed())
+				}
+			})
+
+			It("deletes the flows and the port of the container only", func() {
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+
+				Expect(portNames()).To(ConsistOf("s-010255096002"))
+				Expect(server.rows("Interface")).To(HaveLen(1))
+				Expect(flowsOf("container-1")).To(BeEmpty())
+				Expect(flowsOf("container-2")).To(HaveLen(3))
+			})
+
+			It("removes the recorded port", func() {
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+
+				_, err := loadPortState(n.StateDir, "container-1", "eth0")
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				_, err = loadPortState(n.StateDir, "container-2", "eth0")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("finds the port by its external_ids when it was not recorded", func() {
+				Expect(os.RemoveAll(n.StateDir)).To(Succeed())
+
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+				Expect(portNames()).To(ConsistOf("s-010255096002"))
+			})
+
+			It("still deletes the port when the bridge has no OpenFlow socket anymore", func() {
+				sw.Close()
+
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+				Expect(portNames()).To(ConsistOf("s-010255096002"))
+			})
+
+			It("is idempotent", func() {
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+				Expect(removeFromOVS(n, "container-1", "eth0")).To(Succeed())
+
+				Expect(portNames()).To(ConsistOf("s-010255096002"))
+				Expect(flowsOf("container-2")).To(HaveLen(3))
+			})
+		})
+	})
+
+	Describe("loadNetConf", func() {
+		It("programs flows by default", func() {
+			n, err := loadNetConf([]byte(`{}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n.Mode).To(Equal(modeFlows))
+		})
+
+		It("rejects unknown modes", func() {
+			_, err := loadNetConf([]byte(`{"mode": "agent"}`))
+			Expect(err).To(MatchError(`invalid mode "agent", must be "flows" or "neutron_agent"`))
+		})
+	})
+
+	Describe("hwAddrOf", func() {
+		It("uses the MAC address of the Neutron port", func() {
+			Expect(hwAddrOf(&NetConf{IP: "10.255.96.1", MACAddress: "FA:16:3E:A6:50:C1"})).To(Equal("fa:16:3e:a6:50:c1"))
+		})
+
+		It("derives one from the IP without a Neutron port", func() {
+			Expect(hwAddrOf(&NetConf{IP: "10.255.96.1"})).To(Equal("0a:58:0a:ff:60:01"))
+		})
+
+		It("rejects invalid MAC addresses", func() {
+			_, err := hwAddrOf(&NetConf{IP: "10.255.96.1", MACAddress: "fa:16:3e"})
+			Expect(err).To(MatchError(ContainSubstring(`invalid 'mac_address' "fa:16:3e"`)))
+		})
+	})
+
+	Describe("tunnelIDOf", func() {
+		It("uses the segmentation ID of vxlan and geneve networks", func() {
+			Expect(tunnelIDOf(&NetConf{NetworkType: "vxlan", SegmentationID: 1001})).To(Equal(1001))
+			Expect(tunnelIDOf(&NetConf{NetworkType: "geneve", SegmentationID: 1<<24 - 1})).To(Equal(1<<24 - 1))
+		})
+
+		It("rejects networks that are not tunneled", func() {
+			_, err := tunnelIDOf(&NetConf{NetworkType: "vlan", SegmentationID: 100})
+			Expect(err).To(MatchError(`unsupported network type "vlan", only vxlan and geneve networks can be tunneled`))
+
+			_, err = tunnelIDOf(&NetConf{})
+			Expect(err).To(MatchError(ContainSubstring("Missing 'network_type'")))
+		})
+
+		It("rejects segmentation IDs out of range", func() {
+			_, err := tunnelIDOf(&NetConf{NetworkType: "vxlan"})
+			Expect(err).To(MatchError("invalid segmentation ID 0 of vxlan network"))
+
+			_, err = tunnelIDOf(&NetConf{NetworkType: "vxlan", SegmentationID: 1 << 24})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("syncTunnels", func() {
+		var (
+			dir    string
+			server *fakeOVSDB
+			sw     *fakeSwitch
+			n      *NetConf
+			peers  peerlist.List
+			out    *bytes.Buffer
+		)
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "tunnels")
+			Expect(err).NotTo(HaveOccurred())
+
+			server, err = newFakeOVSDB(filepath.Join(dir, "db.sock"), "br-int", "br-tun")
+			Expect(err).NotTo(HaveOccurred())
+			sw, err = newFakeSwitch(filepath.Join(dir, "br-int.mgmt"))
+			Expect(err).NotTo(HaveOccurred())
+
+			n, err = loadNetConf([]byte(fmt.Sprintf(`{"bridge": "br-int", "ovsdb_socket": "%s"}`, filepath.Join(dir, "db.sock"))))
+			Expect(err).NotTo(HaveOccurred())
+
+			peers = peerlist.List{Peers: []peerlist.Peer{
+				{HostID: "some-host", IP: "10.0.16.5", Ports: []peerlist.Port{
+					{MACAddress: "fa:16:3e:00:00:01", IP: "10.255.96.1", SegmentationID: 1001},
+				}},
+				{HostID: "other-host", IP: "10.0.16.6", Ports: []peerlist.Port{
+					{MACAddress: "fa:16:3e:00:00:02", IP: "10.255.96.2", SegmentationID: 1001},
+				}},
+				{HostID: "idle-host", IP: "10.0.16.7", Ports: []peerlist.Port{}},
+			}}
+			out = &bytes.Buffer{}
+		})
+
+		AfterEach(func() {
+			sw.Close()
+			server.Close()
+			os.RemoveAll(dir)
+		})
+
+		sync := func(tunnelType string, dryRun bool) {
+			Expect(syncTunnels(n, peers, tunnelType, "10.0.16.5", dryRun, out)).To(Succeed())
+		}
+
+		// the type and options of each interface
+		tunnels := func() map[string]map[string]string {
+			tunnels := map[string]map[string]string{}
+			for _, row := range server.rows("Interface") {
+				options := ovsdbMapValue(row["options"])
+				if row["type"] != nil {
+					options["type"] = row["type"].(string)
+				}
+				tunnels[row["name"].(string)] = options
+			}
+			return tunnels
+		}
+
+		ofportOf := func(name string) int {
+			for _, row := range server.rows("Interface") {
+				if row["name"] == name {
+					return int(row["ofport"].(float64))
+				}
+			}
+			return 0
+		}
+
+		lines := func() []string {
+			return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		}
+
+		flowsOf := func(remoteIP string) []string {
+			var flows []string
+			for _, mod := range sw.installed() {
+				flow := describeFlowMod(mod)
+				if strings.HasPrefix(flow, fmt.Sprintf("cookie=%#x,", tunnelCookie(remoteIP))) {
+					flows = append(flows, strings.SplitN(flow, ",", 2)[1])
+				}
+			}
+			return flows
+		}
+
+		It("adds a tunnel port to each other host", func() {
+			sync("vxlan", false)
+
+			Expect(lines()).To(ConsistOf(
+				fmt.Sprintf("+ vxlan tunnel %s to 10.0.16.6 (other-host)", tunnelName("10.0.16.6")),
+				fmt.Sprintf("+ vxlan tunnel %s to 10.0.16.7 (idle-host)", tunnelName("10.0.16.7")),
+			))
+			Expect(tunnels()).To(Equal(map[string]map[string]string{
+				tunnelName("10.0.16.6"): {"type": "vxlan", "remote_ip": "10.0.16.6", "local_ip": "10.0.16.5", "key": "flow"},
+				tunnelName("10.0.16.7"): {"type": "vxlan", "remote_ip": "10.0.16.7", "local_ip": "10.0.16.5", "key": "flow"},
+			}))
+		})
+
+		It("sends traffic for the containers on a host through its tunnel", func() {
+			sync("vxlan", false)
+
+			port := ofportOf(tunnelName("10.0.16.6"))
+			Expect(flowsOf("10.0.16.6")).To(Equal([]string{
+				fmt.Sprintf("table=0,priority=32768,in_port=%d actions=goto_table:1", port),
+				fmt.Sprintf("table=1,priority=32768,tun_id=1001,dl_dst=fa:16:3e:00:00:02 actions=output:%d", port),
+				fmt.Sprintf("table=1,priority=32768,tun_id=1001,dl_type=0x0806,arp_tpa=10.255.96.2 actions=output:%d", port),
+			}))
+			Expect(flowsOf("10.0.16.7")).To(Equal([]string{
+				fmt.Sprintf("table=0,priority=32768,in_port=%d actions=goto_table:1", ofportOf(tunnelName("10.0.16.7"))),
+			}))
+			Expect(flowsOf("10.0.16.5")).To(BeEmpty())
+			Expect(sw.bundles).To(Equal(1))
+		})
+
+		It("replaces the flows when the containers on a host change", func() {
+			sync("vxlan", false)
+
+			peers.Peers[1].Ports = []peerlist.Port{
+				{MACAddress: "fa:16:3e:00:00:03", IP: "10.255.96.3", IP6: "fd00::3", SegmentationID: 1002},
+			}
+			out.Reset()
+			sync("vxlan", false)
+
+			Expect(out.String()).To(BeEmpty())
+			port := ofportOf(tunnelName("10.0.16.6"))
+			Expect(flowsOf("10.0.16.6")).To(Equal([]string{
+				fmt.Sprintf("table=0,priority=32768,in_port=%d actions=goto_table:1", port),
+				fmt.Sprintf("table=1,priority=32768,tun_id=1002,dl_dst=fa:16:3e:00:00:03 actions=output:%d", port),
+				fmt.Sprintf("table=1,priority=32768,tun_id=1002,dl_type=0x0806,arp_tpa=10.255.96.3 actions=output:%d", port),
+				fmt.Sprintf("table=1,priority=32768,tun_id=1002,dl_type=0x86dd,nw_proto=58,icmp_type=135,nd_target=fd00::3 actions=output:%d", port),
+			}))
+			Expect(flowsOf("10.0.16.7")).To(HaveLen(1))
+		})
+
+		It("removes the tunnel and flows of hosts that are gone", func() {
+			sync("vxlan", false)
+
+			peers.Peers = peers.Peers[:2]
+			out.Reset()
+			sync("vxlan", false)
+
+			Expect(out.String()).To(Equal(fmt.Sprintf("- vxlan tunnel %s to 10.0.16.7\n", tunnelName("10.0.16.7"))))
+			Expect(tunnels()).To(HaveKey(tunnelName("10.0.16.6")))
+			Expect(tunnels()).NotTo(HaveKey(tunnelName("10.0.16.7")))
+			Expect(flowsOf("10.0.16.7")).To(BeEmpty())
+			Expect(flowsOf("10.0.16.6")).To(HaveLen(3))
+		})
+
+		It("recreates tunnels of another type", func() {
+			sync("vxlan", false)
+			out.Reset()
+			sync("geneve", false)
+
+			Expect(out.String()).To(ContainSubstring(fmt.Sprintf("- vxlan tunnel %s to 10.0.16.6\n+ geneve tunnel %s to 10.0.16.6 (other-host)\n",
+				tunnelName("10.0.16.6"), tunnelName("10.0.16.6"))))
+			Expect(lines()).To(HaveLen(4))
+			Expect(tunnels()[tunnelName("10.0.16.6")]).To(HaveKeyWithValue("type", "geneve"))
+			Expect(flowsOf("10.0.16.6")).To(HaveLen(3))
+		})
+
+		It("leaves tunnels it does not manage alone", func() {
+			db, err := dialOVSDB(n.OVSDBSocket)
+			Expect(err).NotTo(HaveOccurred())
+			defer db.Close()
+			Expect(db.addPort("br-int", "s-010255096001", nil)).To(Succeed())
+
+			sync("vxlan", false)
+			peers.Peers = nil
+			sync("vxlan", false)
+
+			Expect(tunnels()).To(HaveLen(1))
+			Expect(tunnels()).To(HaveKey("s-010255096001"))
+		})
+
+		It("leaves tunnels on other bridges alone", func() {
+			db, err := dialOVSDB(n.OVSDBSocket)
+			Expect(err).NotTo(HaveOccurred())
+			defer db.Close()
+			Expect(db.addPort("br-tun", "gofer-other", map[string]interface{}{
+				"type":         "vxlan",
+				"options":      ovsdbMap(map[string]string{"remote_ip": "10.0.16.9"}),
+				"external_ids": ovsdbMap(map[string]string{tunnelPeerKey: "other-cluster-host"}),
+			})).To(Succeed())
+
+			sync("vxlan", false)
+
+			Expect(out.String()).NotTo(ContainSubstring("gofer-other"))
+			Expect(tunnels()).To(HaveKey("gofer-other"))
+		})
+
+		It("changes nothing in a dry run", func() {
+			sync("vxlan", true)
+
+			Expect(out.String()).To(ContainSubstring("+ vxlan tunnel"))
+			Expect(tunnels()).To(BeEmpty())
+			Expect(sw.installed()).To(BeEmpty())
+		})
+
+		It("loads the peers from a file or a URL", func() {
+			data, err := json.Marshal(peers)
+			Expect(err).NotTo(HaveOccurred())
+
+			path := filepath.Join(dir, "peers.json")
+			Expect(ioutil.WriteFile(path, data, 0600)).To(Succeed())
+			Expect(loadPeers(path)).To(Equal(peers))
+
+			endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(data)
+			}))
+			defer endpoint.Close()
+			Expect(loadPeers(endpoint.URL)).To(Equal(peers))
+		})
+	})
 })
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+const ovsdbDatabase = "Open_vSwitch"
+const ovsdbTimeout = 10 * time.Second
+
+// ovsdbClient is a minimal OVSDB JSON-RPC client (RFC 7047) for the
+// Open_vSwitch database. It talks to ovsdb-server on its unix socket, so
+// bridge and interface names never go through a shell.
+type ovsdbClient struct {
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	nextID int
+}
+
+func dialOVSDB(socket string) (*ovsdbClient, error) {
+	conn, err := net.DialTimeout("unix", socket, ovsdbTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ovsdb at %s: %v", socket, err)
+	}
+	return &ovsdbClient{
+		conn: conn,
+		enc:  json.NewEncoder(conn),
+		dec:  json.NewDecoder(conn),
+	}, nil
+}
+
+func (c *ovsdbClient) Close() error {
+	return c.conn.Close()
+}
+
+type ovsdbMessage struct {
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  interface{}     `json:"error,omitempty"`
+	ID     interface{}     `json:"id"`
+}
+
+// call sends a request and waits for its response, answering the echo
+// requests ovsdb-server uses as keepalive in the meantime.
+func (c *ovsdbClient) call(method string, params []interface{}, result interface{}) error {
+	c.nextID++
+	id := c.nextID
+
+	c.conn.SetDeadline(time.Now().Add(ovsdbTimeout))
+	req := map[string]interface{}{"method": method, "params": params, "id": id}
+	if err := c.enc.Encode(req); err != nil {
+		return fmt.Errorf("ovsdb %s failed: %v", method, err)
+	}
+
+	for {
+		var msg ovsdbMessage
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("ovsdb %s failed: %v", method, err)
+		}
+
+		switch {
+		case msg.Method == "echo":
+			reply := map[string]interface{}{"result": msg.Params, "error": nil, "id": msg.ID}
+			if err := c.enc.Encode(reply); err != nil {
+				return fmt.Errorf("ovsdb %s failed: %v", method, err)
+			}
+		case msg.Method != "":
+			// notifications, e.g. of monitors, are of no interest here
+		case fmt.Sprint(msg.ID) != fmt.Sprint(id):
+			// not our response
+		case msg.Error != nil:
+			return fmt.Errorf("ovsdb %s failed: %v", method, msg.Error)
+		default:
+			return json.Unmarshal(msg.Result, result)
+		}
+	}
+}
+
+// ovsdbOp is an operation of a transaction, see RFC 7047 section 5.2.
+type ovsdbOp map[string]interface{}
+
+type ovsdbOpResult struct {
+	UUID    []interface{}            `json:"uuid"`
+	Rows    []map[string]interface{} `json:"rows"`
+	Count   int                      `json:"count"`
+	Error   string                   `json:"error"`
+	Details string                   `json:"details"`
+}
+
+// transact runs operations as a single transaction, which either commits
+// all of them or none.
+func (c *ovsdbClient) transact(ops ...ovsdbOp) ([]ovsdbOpResult, error) {
+	params := []interface{}{ovsdbDatabase}
+	for _, op := range ops {
+		params = append(params, op)
+	}
+
+	var results []ovsdbOpResult
+	if err := c.call("transact", params, &results); err != nil {
+		return nil, err
+	}
+
+	// a failed operation has an error in its result, a failed commit an
+	// extra result after those of the operations
+	for i, r := range results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("ovsdb transaction failed at operation %d: %s: %s", i, r.Error, r.Details)
+		}
+	}
+	if len(results) < len(ops) {
+		return nil, fmt.Errorf("ovsdb transaction returned %d results for %d operations", len(results), len(ops))
+	}
+	return results, nil
+}
+
+// addPort adds an interface as a port of a bridge, setting columns of the
+// interface such as ofport_request or external_ids in the same transaction.
+func (c *ovsdbClient) addPort(bridge, name string, columns map[string]interface{}) error {
+	iface := map[string]interface{}{"name": name}
+	for k, v := range columns {
+		iface[k] = v
+	}
+
+	_, err := c.transact(
+		// fail unless the bridge exists, instead of leaving a dangling port
+		ovsdbOp{
+			"op":      "wait",
+			"table":   "Bridge",
+			"where":   ovsdbWhere("name", bridge),
+			"columns": []string{"name"},
+			"until":   "==",
+			"rows":    []interface{}{map[string]interface{}{"name": bridge}},
+			"timeout": 0,
+		},
+		ovsdbOp{
+			"op":        "insert",
+			"table":     "Interface",
+			"row":       iface,
+			"uuid-name": "iface",
+		},
+		ovsdbOp{
+			"op":    "insert",
+			"table": "Port",
+			"row": map[string]interface{}{
+				"name":       name,
+				"interfaces": ovsdbNamedUUID("iface"),
+			},
+			"uuid-name": "port",
+		},
+		ovsdbOp{
+			"op":        "mutate",
+			"table":     "Bridge",
+			"where":     ovsdbWhere("name", bridge),
+			"mutations": []interface{}{[]interface{}{"ports", "insert", ovsdbSet(ovsdbNamedUUID("port"))}},
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to add port %s to bridge %s: %v", name, bridge, err)
+	}
+	return nil
+}
+
+// deletePort removes a port from a bridge. ovsdb-server garbage collects the
+// port and its interface once no bridge refers to them. Ports that are gone
+// already are ignored.
+func (c *ovsdbClient) deletePort(bridge, name string) error {
+	results, err := c.transact(ovsdbOp{
+		"op":      "select",
+		"table":   "Port",
+		"where":   ovsdbWhere("name", name),
+		"columns": []string{"_uuid"},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to look up port %s: %v", name, err)
+	}
+
+	var uuids []interface{}
+	for _, row := range results[0].Rows {
+		uuids = append(uuids, row["_uuid"])
+	}
+	if len(uuids) == 0 {
+		return nil
+	}
+
+	_, err = c.transact(ovsdbOp{
+		"op":        "mutate",
+		"table":     "Bridge",
+		"where":     ovsdbWhere("name", bridge),
+		"mutations": []interface{}{[]interface{}{"ports", "delete", ovsdbSet(uuids...)}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete port %s from bridge %s: %v", name, bridge, err)
+	}
+	return nil
+}
+
+// ovsdbPollInterval is how often ofport polls for the port number
+const ovsdbPollInterval = 100 * time.Millisecond
+
+// ofport returns the OpenFlow port number ovs-vswitchd assigned to an
+// interface, waiting for it to add the interface to the datapath.
+func (c *ovsdbClient) ofport(name string) (int, error) {
+	deadline := time.Now().Add(ovsdbTimeout)
+	for {
+		results, err := c.transact(ovsdbOp{
+			"op":      "select",
+			"table":   "Interface",
+			"where":   ovsdbWhere("name", name),
+			"columns": []string{"ofport", "error"},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up interface %s: %v", name, err)
+		}
+		if len(results[0].Rows) == 0 {
+			return 0, fmt.Errorf("interface %s not found", name)
+		}
+
+		// the column is an empty set until ovs-vswitchd gets to it, and -1 if
+		// it failed to add the interface
+		row := results[0].Rows[0]
+		if ofport, ok := row["ofport"].(float64); ok {
+			if ofport < 1 {
+				return 0, fmt.Errorf("failed to add interface %s: %v", name, row["error"])
+			}
+			return int(ofport), nil
+		}
+
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timed out waiting for the ofport of interface %s", name)
+		}
+		time.Sleep(ovsdbPollInterval)
+	}
+}
+
+// interfacesByExternalIDs returns the names of the interfaces whose
+// external_ids include all of ids.
+func (c *ovsdbClient) interfacesByExternalIDs(ids map[string]string) ([]string, error) {
+	results, err := c.transact(ovsdbOp{
+		"op":      "select",
+		"table":   "Interface",
+		"where":   []interface{}{[]interface{}{"external_ids", "includes", ovsdbMap(ids)}},
+		"columns": []string{"name"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up interfaces: %v", err)
+	}
+
+	var names []string
+	for _, row := range results[0].Rows {
+		if name, ok := row["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// ovsdbInterface is a row of the Interface table.
+type ovsdbInterface struct {
+	Name        string
+	Type        string
+	Options     map[string]string
+	ExternalIDs map[string]string
+}
+
+// interfaces returns the interfaces of the ports on a bridge.
+func (c *ovsdbClient) interfaces(bridge string) ([]ovsdbInterface, error) {
+	results, err := c.transact(ovsdbOp{
+		"op":      "select",
+		"table":   "Bridge",
+		"where":   ovsdbWhere("name", bridge),
+		"columns": []string{"ports"},
+	}, ovsdbOp{
+		"op":      "select",
+		"table":   "Port",
+		"where":   []interface{}{},
+		"columns": []string{"_uuid", "interfaces"},
+	}, ovsdbOp{
+		"op":      "select",
+		"table":   "Interface",
+		"where":   []interface{}{},
+		"columns": []string{"_uuid", "name", "type", "options", "external_ids"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces of bridge %s: %v", bridge, err)
+	}
+
+	ports := map[string]bool{}
+	for _, row := range results[0].Rows {
+		for _, id := range ovsdbUUIDs(row["ports"]) {
+			ports[id] = true
+		}
+	}
+	onBridge := map[string]bool{}
+	for _, row := range results[1].Rows {
+		if id := ovsdbUUIDs(row["_uuid"]); len(id) == 1 && ports[id[0]] {
+			for _, iface := range ovsdbUUIDs(row["interfaces"]) {
+				onBridge[iface] = true
+			}
+		}
+	}
+
+	var interfaces []ovsdbInterface
+	for _, row := range results[2].Rows {
+		if id := ovsdbUUIDs(row["_uuid"]); len(id) != 1 || !onBridge[id[0]] {
+			continue
+		}
+		name, _ := row["name"].(string)
+		ifaceType, _ := row["type"].(string)
+		interfaces = append(interfaces, ovsdbInterface{
+			Name:        name,
+			Type:        ifaceType,
+			Options:     ovsdbMapValue(row["options"]),
+			ExternalIDs: ovsdbMapValue(row["external_ids"]),
+		})
+	}
+	return interfaces, nil
+}
+
+func ovsdbWhere(column string, value interface{}) []interface{} {
+	return []interface{}{[]interface{}{column, "==", value}}
+}
+
+func ovsdbNamedUUID(name string) []interface{} {
+	return []interface{}{"named-uuid", name}
+}
+
+func ovsdbSet(values ...interface{}) []interface{} {
+	if values == nil {
+		values = []interface{}{}
+	}
+	return []interface{}{"set", values}
+}
+
+func ovsdbMap(m map[string]string) []interface{} {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := []interface{}{}
+	for _, k := range keys {
+		pairs = append(pairs, []interface{}{k, m[k]})
+	}
+	return []interface{}{"map", pairs}
+}
+
+// ovsdbUUIDs returns the uuids of a uuid column or a set of them.
+func ovsdbUUIDs(value interface{}) []string {
+	column, ok := value.([]interface{})
+	if !ok || len(column) != 2 {
+		return nil
+	}
+	switch column[0] {
+	case "uuid":
+		id, _ := column[1].(string)
+		return []string{id}
+	case "set":
+		var ids []string
+		elements, _ := column[1].([]interface{})
+		for _, e := range elements {
+			ids = append(ids, ovsdbUUIDs(e)...)
+		}
+		return ids
+	}
+	return nil
+}
+
+// ovsdbMapValue converts a map column to a map of strings.
+func ovsdbMapValue(value interface{}) map[string]string {
+	m := map[string]string{}
+	column, ok := value.([]interface{})
+	if !ok || len(column) != 2 || column[0] != "map" {
+		return m
+	}
+	pairs, _ := column[1].([]interface{})
+	for _, p := range pairs {
+		pair, ok := p.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		k, _ := pair[0].(string)
+		v, _ := pair[1].(string)
+		m[k] = v
+	}
+	return m
+}
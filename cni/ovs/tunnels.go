@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/markstgodard/gofer/cni/peerlist"
+)
+
+const defaultTunnelInterval = time.Minute
+
+// tunnelPeerKey is the external_ids key marking the tunnel ports `tunnels`
+// manages, with the host ID of the peer as value.
+const tunnelPeerKey = "gofer_peer"
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// runTunnels implements `ovs tunnels`, which keeps a tunnel port to every
+// other host on the bridge, and flows sending traffic for the containers on
+// a host through its tunnel.
+func runTunnels(args []string) error {
+	flags := flag.NewFlagSet("tunnels", flag.ContinueOnError)
+	configPath := flags.String("config", "", "CNI net config of the plugin with the bridge and sockets")
+	peersSource := flags.String("peers", "", "file or http(s) URL with the output of `gofer peers`")
+	tunnelType := flags.String("type", "vxlan", "tunnel type, vxlan or geneve")
+	localIP := flags.String("local-ip", "", "IP the tunnels of this host end at")
+	interval := flags.Duration("interval", defaultTunnelInterval, "time between syncs")
+	dryRun := flags.Bool("dry-run", false, "print the tunnel changes once without applying them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *peersSource == "" || *localIP == "" {
+		return errors.New("tunnels requires -peers and -local-ip")
+	}
+	if *tunnelType != "vxlan" && *tunnelType != "geneve" {
+		return fmt.Errorf("unsupported tunnel type %q", *tunnelType)
+	}
+
+	conf := []byte("{}")
+	if *configPath != "" {
+		var err error
+		if conf, err = ioutil.ReadFile(*configPath); err != nil {
+			return err
+		}
+	}
+	n, err := loadNetConf(conf)
+	if err != nil {
+		return err
+	}
+
+	sync := func() error {
+		peers, err := loadPeers(*peersSource)
+		if err != nil {
+			return fmt.Errorf("error loading peers: %v", err)
+		}
+		return syncTunnels(n, peers, *tunnelType, *localIP, *dryRun, os.Stdout)
+	}
+
+	if *dryRun {
+		return sync()
+	}
+
+	for {
+		if err := sync(); err != nil {
+			log.Printf("tunnels: %v", err)
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func loadPeers(source string) (peerlist.List, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := httpClient.Get(source)
+		if err != nil {
+			return peerlist.List{}, err
+		}
+		defer resp.Body.Close()
+
+		data, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return peerlist.List{}, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return peerlist.List{}, fmt.Errorf("%s returned %s: %s", source, resp.Status, data)
+		}
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(source); err != nil {
+			return peerlist.List{}, err
+		}
+	}
+
+	var peers peerlist.List
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return peerlist.List{}, fmt.Errorf("error parsing %s: %v", source, err)
+	}
+	return peers, nil
+}
+
+// tunnelName names the tunnel port to a peer after its IP, so it stays the
+// same across syncs and fits in an interface name.
+func tunnelName(remoteIP string) string {
+	h := fnv.New32a()
+	h.Write([]byte(remoteIP))
+	return fmt.Sprintf("tun-%08x", h.Sum32())
+}
+
+// tunnelCookie identifies the flows of the tunnel to a peer.
+func tunnelCookie(remoteIP string) uint64 {
+	return containerCookie("tunnel:" + remoteIP)
+}
+
+// syncTunnels converges the tunnel ports of the bridge and their flows on
+// the peer list. The flows of all tunnels are replaced in one bundle, so
+// traffic never sees a partial update.
+func syncTunnels(n *NetConf, peers peerlist.List, tunnelType, localIP string, dryRun bool, out io.Writer) error {
+	db, err := dialOVSDB(n.OVSDBSocket)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// stale tunnels are deleted from the bridge, so only tunnels on it count
+	interfaces, err := db.interfaces(n.BrName)
+	if err != nil {
+		return err
+	}
+	existing := map[string]ovsdbInterface{}
+	for _, iface := range interfaces {
+		if _, ok := iface.ExternalIDs[tunnelPeerKey]; ok {
+			existing[iface.Name] = iface
+		}
+	}
+
+	wanted := map[string]peerlist.Peer{}
+	for _, p := range peers.Peers {
+		if p.IP == localIP {
+			continue
+		}
+		if net.ParseIP(p.IP) == nil {
+			return fmt.Errorf("invalid IP %q of peer %s", p.IP, p.HostID)
+		}
+		wanted[tunnelName(p.IP)] = p
+	}
+
+	var names []string
+	for name := range wanted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := func(p peerlist.Peer) map[string]string {
+		return map[string]string{
+			"remote_ip": p.IP,
+			"local_ip":  localIP,
+			"key":       "flow",
+		}
+	}
+
+	for _, name := range names {
+		p := wanted[name]
+		if iface, ok := existing[name]; ok {
+			if iface.Type == tunnelType && iface.Options["remote_ip"] == p.IP && iface.Options["local_ip"] == localIP {
+				continue
+			}
+			// tunnels are recreated rather than updated in place
+			fmt.Fprintf(out, "- %s tunnel %s to %s\n", iface.Type, name, iface.Options["remote_ip"])
+			if !dryRun {
+				if err := db.deletePort(n.BrName, name); err != nil {
+					return err
+				}
+			}
+		}
+
+		fmt.Fprintf(out, "+ %s tunnel %s to %s (%s)\n", tunnelType, name, p.IP, p.HostID)
+		if dryRun {
+			continue
+		}
+		err := db.addPort(n.BrName, name, map[string]interface{}{
+			"type":         tunnelType,
+			"options":      ovsdbMap(options(p)),
+			"external_ids": ovsdbMap(map[string]string{tunnelPeerKey: p.HostID}),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var stale []string
+	for name := range existing {
+		if _, ok := wanted[name]; !ok {
+			stale = append(stale, name)
+		}
+	}
+	sort.Strings(stale)
+	for _, name := range stale {
+		fmt.Fprintf(out, "- %s tunnel %s to %s\n", existing[name].Type, name, existing[name].Options["remote_ip"])
+	}
+
+	if dryRun {
+		return nil
+	}
+
+	var mods []flowMod
+	for _, name := range stale {
+		mods = append(mods, deleteFlows(tunnelCookie(existing[name].Options["remote_ip"])))
+	}
+	for _, name := range names {
+		p := wanted[name]
+		ofport, err := db.ofport(name)
+		if err != nil {
+			return err
+		}
+		flows, err := tunnelFlows(p, uint32(ofport))
+		if err != nil {
+			return err
+		}
+		mods = append(mods, deleteFlows(tunnelCookie(p.IP)))
+		mods = append(mods, flows...)
+	}
+
+	of, err := dialOpenFlow(n.OpenFlowSocket)
+	if err != nil {
+		return err
+	}
+	defer of.Close()
+
+	if err := of.bundle(mods...); err != nil {
+		return fmt.Errorf("error replacing tunnel flows: %v", err)
+	}
+
+	// the ports go after their flows, so no traffic is sent to them
+	for _, name := range stale {
+		if err := db.deletePort(n.BrName, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tunnelFlows returns the flows of the tunnel to a peer: table 0 passes
+// traffic from the tunnel, which has the tunnel ID of its network already,
+// on to table 1, where traffic for the containers on the peer is sent into
+// the tunnel.
+func tunnelFlows(p peerlist.Peer, port uint32) ([]flowMod, error) {
+	cookie := tunnelCookie(p.IP)
+	flows := []flowMod{{
+		command:      ofpfcAdd,
+		table:        0,
+		priority:     defaultFlowPriority,
+		cookie:       cookie,
+		match:        []oxmField{matchInPort(port)},
+		instructions: [][]byte{gotoTable(1)},
+	}}
+
+	for _, c := range p.Ports {
+		mac, err := net.ParseMAC(c.MACAddress)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MAC %q of a port on %s: %v", c.MACAddress, p.HostID, err)
+		}
+		ip := net.ParseIP(c.IP)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IP %q of a port on %s", c.IP, p.HostID)
+		}
+		var ip6 net.IP
+		if c.IP6 != "" {
+			if ip6 = net.ParseIP(c.IP6); ip6 == nil {
+				return nil, fmt.Errorf("invalid IPv6 address %q of a port on %s", c.IP6, p.HostID)
+			}
+		}
+		flows = append(flows, deliveryFlows(cookie, port, uint64(c.SegmentationID), ip, ip6, mac)...)
+	}
+	return flows, nil
+}
@@ -0,0 +1,24 @@
+// Package peerlist defines the container table of the hosts of a cluster,
+// which `gofer peers` prints and the ovs plugin's `tunnels` command turns
+// into tunnel ports and flows.
+package peerlist
+
+// List is the IP of each host of the cluster and the addresses of the
+// container ports on it.
+type List struct {
+	Peers []Peer `json:"peers"`
+}
+
+type Peer struct {
+	HostID string `json:"host_id"`
+	IP     string `json:"ip"`
+	Ports  []Port `json:"ports"`
+}
+
+// Port is a container port; IP6 is only set on dual-stack networks.
+type Port struct {
+	MACAddress     string `json:"mac_address"`
+	IP             string `json:"ip"`
+	IP6            string `json:"ip6,omitempty"`
+	SegmentationID int    `json:"segmentation_id"`
+}
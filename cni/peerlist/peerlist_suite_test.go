@@ -0,0 +1,13 @@
+package peerlist_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPeerlist(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Peerlist Suite")
+}
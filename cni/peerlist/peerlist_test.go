@@ -0,0 +1,45 @@
+package peerlist_test
+
+import (
+	"encoding/json"
+
+	"github.com/markstgodard/gofer/cni/peerlist"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("List", func() {
+	list := peerlist.List{Peers: []peerlist.Peer{
+		{HostID: "some-host", IP: "10.0.16.5", Ports: []peerlist.Port{
+			{MACAddress: "fa:16:3e:00:00:01", IP: "10.255.96.1", IP6: "fd00::1", SegmentationID: 1001},
+		}},
+		{HostID: "other-host", IP: "10.0.16.6", Ports: []peerlist.Port{
+			{MACAddress: "fa:16:3e:00:00:02", IP: "10.255.96.2", SegmentationID: 1001},
+		}},
+		{HostID: "idle-host", IP: "10.0.16.7", Ports: []peerlist.Port{}},
+	}}
+
+	It("survives a round trip through JSON", func() {
+		data, err := json.Marshal(list)
+		Expect(err).NotTo(HaveOccurred())
+
+		var decoded peerlist.List
+		Expect(json.Unmarshal(data, &decoded)).To(Succeed())
+		Expect(decoded).To(Equal(list))
+	})
+
+	It("leaves out the IPv6 address of IPv4-only ports", func() {
+		data, err := json.Marshal(list)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"peers": [
+  {"host_id": "some-host", "ip": "10.0.16.5", "ports": [
+    {"mac_address": "fa:16:3e:00:00:01", "ip": "10.255.96.1", "ip6": "fd00::1", "segmentation_id": 1001}
+  ]},
+  {"host_id": "other-host", "ip": "10.0.16.6", "ports": [
+    {"mac_address": "fa:16:3e:00:00:02", "ip": "10.255.96.2", "segmentation_id": 1001}
+  ]},
+  {"host_id": "idle-host", "ip": "10.0.16.7", "ports": []}
+]}`))
+	})
+})
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/markstgodard/gofer/cni/peerlist"
+)
+
+// runPeers implements `gofer peers`, which prints the peer list of the
+// cluster: the IP of each host and the addresses of the container ports on
+// it, according to Neutron.
+func runPeers(args []string) error {
+	flags := flag.NewFlagSet("peers", flag.ContinueOnError)
+	configPath := flags.String("config", "", "CNI net config with the neutron and keystone settings")
+	hostsPath := flags.String("hosts", "", "JSON or YAML map of host IDs to the IPs their tunnels end at")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath == "" || *hostsPath == "" {
+		return errors.New("peers requires -config and -hosts")
+	}
+
+	n, err := loadNetConfigFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(*hostsPath)
+	if err != nil {
+		return err
+	}
+	var hosts map[string]string
+	if err := yaml.Unmarshal(data, &hosts); err != nil {
+		return fmt.Errorf("error parsing %s: %w", *hostsPath, err)
+	}
+
+	err = withNeutron(n, func(client *neutronClient) error {
+		peers, err := buildPeerList(client, n, hosts, os.Stderr)
+		if err != nil {
+			return err
+		}
+		return json.NewEncoder(os.Stdout).Encode(peers)
+	})
+	return redactSecrets(err, n)
+}
+
+// buildPeerList lists the container ports of the cluster by the host they
+// are bound to. Ports that are not bound have the host of the ADD in their
+// tags. Ports of hosts missing from hosts, and of networks without a
+// segmentation ID to tunnel them with, are left out with a warning.
+func buildPeerList(client *neutronClient, n *NetConf, hosts map[string]string, warnings io.Writer) (peerlist.List, error) {
+	q := url.Values{}
+	for _, owner := range deviceOwners {
+		q.Add("device_owner", owner)
+	}
+	ports, err := client.PortBindings(withTags(q, ownerTags(n)))
+	if err != nil {
+		return peerlist.List{}, fmt.Errorf("error listing neutron ports: %w", err)
+	}
+
+	byHost := map[string][]peerlist.Port{}
+	segments := map[string]int{}
+	unsegmented := map[string]bool{}
+	for _, p := range ports {
+		host := p.HostID
+		if host == "" {
+			for _, tag := range p.Tags {
+				if strings.HasPrefix(tag, "host:") {
+					host = strings.TrimPrefix(tag, "host:")
+				}
+			}
+		}
+		if _, ok := hosts[host]; !ok {
+			fmt.Fprintf(warnings, "skipping port %s of unknown host %q\n", p.ID, host)
+			continue
+		}
+
+		if unsegmented[p.NetworkID] {
+			continue
+		}
+		segmentationID, ok := segments[p.NetworkID]
+		if !ok {
+			network, err := client.Network(p.NetworkID)
+			if err != nil {
+				return peerlist.List{}, fmt.Errorf("error looking up neutron network %s: %w", p.NetworkID, err)
+			}
+			if network.SegmentationID == nil {
+				// flat networks, or provider attributes hidden from us
+				fmt.Fprintf(warnings, "skipping ports of neutron network %s without provider:segmentation_id\n", p.NetworkID)
+				unsegmented[p.NetworkID] = true
+				continue
+			}
+			segmentationID = *network.SegmentationID
+			segments[p.NetworkID] = segmentationID
+		}
+
+		ip, ip6, err := portIPs(p.Port)
+		if err != nil {
+			return peerlist.List{}, err
+		}
+		port := peerlist.Port{
+			MACAddress:     p.MACAddress,
+			IP:             ip.IP,
+			SegmentationID: segmentationID,
+		}
+		if ip6 != nil {
+			port.IP6 = ip6.IP
+		}
+		byHost[host] = append(byHost[host], port)
+	}
+
+	// sorted, so the list only changes when the ports do
+	var peers peerlist.List
+	for host, ip := range hosts {
+		ports := byHost[host]
+		sort.Slice(ports, func(i, j int) bool { return ports[i].MACAddress < ports[j].MACAddress })
+		if ports == nil {
+			ports = []peerlist.Port{}
+		}
+		peers.Peers = append(peers.Peers, peerlist.Peer{HostID: host, IP: ip, Ports: ports})
+	}
+	sort.Slice(peers.Peers, func(i, j int) bool { return peers.Peers[i].HostID < peers.Peers[j].HostID })
+	return peers, nil
+}
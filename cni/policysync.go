@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// policySyncDescription marks the security group rules owned by
+// `gofer policy-sync`, so rules added by hand or by ADD are left alone.
+const policySyncDescription = "gofer policy-sync"
+
+const defaultPolicySyncInterval = time.Minute
+
+// policyList is an export of Cloud Foundry container networking policies,
+// as returned by the policy server's /networking/v1/external/policies.
+type policyList struct {
+	Policies []policy `json:"policies"`
+}
+
+type policy struct {
+	Source      policySource      `json:"source"`
+	Destination policyDestination `json:"destination"`
+}
+
+type policySource struct {
+	ID string `json:"id"`
+}
+
+type policyDestination struct {
+	ID       string    `json:"id"`
+	Protocol string    `json:"protocol"`
+	Port     int       `json:"port"`
+	Ports    portRange `json:"ports"`
+}
+
+type portRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// runPolicySync implements `gofer policy-sync`, which keeps the security
+// group rules between policy groups in line with the Cloud Foundry network
+// policies in a JSON or YAML export. It prints the rules it adds (+) and
+// removes (-), and the errors of failed syncs (!).
+func runPolicySync(args []string) error {
+	flags := flag.NewFlagSet("policy-sync", flag.ContinueOnError)
+	configPath := flags.String("config", "", "CNI net config with the neutron and keystone settings")
+	policiesPath := flags.String("policies", "", "JSON or YAML export of Cloud Foundry network policies")
+	interval := flags.Duration("interval", defaultPolicySyncInterval, "time between syncs")
+	dryRun := flags.Bool("dry-run", false, "print the rule changes once without applying them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *configPath == "" || *policiesPath == "" {
+		return errors.New("policy-sync requires -config and -policies")
+	}
+
+	n, err := loadNetConfigFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *dryRun {
+		return redactSecrets(syncPolicies(n, *policiesPath, true, out), n)
+	}
+
+	// a failed sync is retried on the next one
+	for {
+		if err := syncPolicies(n, *policiesPath, false, out); err != nil {
+			fmt.Fprintf(out, "! %v\n", redactSecrets(err, n))
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// syncPolicies re-reads the policy export, so policy changes are picked up
+// without a restart, and reconciles the rules once.
+func syncPolicies(n *NetConf, policiesPath string, dryRun bool, out io.Writer) error {
+	policies, err := loadPolicies(policiesPath)
+	if err != nil {
+		return err
+	}
+
+	return withNeutron(n, func(client *neutronClient) error {
+		return reconcilePolicies(client, n, policies, dryRun, out)
+	})
+}
+
+func loadPolicies(path string) ([]policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is a subset of YAML, so both formats parse the same way
+	var list policyList
+	if err := yaml.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to load policies %s: %w", path, err)
+	}
+
+	for i, p := range list.Policies {
+		if p.Source.ID == "" || p.Destination.ID == "" {
+			return nil, fmt.Errorf("policy %d in %s is missing a source or destination id", i, path)
+		}
+		switch p.Destination.Protocol {
+		case "tcp", "udp":
+		default:
+			return nil, fmt.Errorf("policy %d in %s has invalid protocol %q", i, path, p.Destination.Protocol)
+		}
+
+		// older exports have a single port instead of a range
+		if p.Destination.Ports.Start == 0 {
+			list.Policies[i].Destination.Ports = portRange{Start: p.Destination.Port, End: p.Destination.Port}
+		}
+		ports := list.Policies[i].Destination.Ports
+		if ports.Start < 1 || ports.End < ports.Start || ports.End > 65535 {
+			return nil, fmt.Errorf("policy %d in %s has invalid ports %d-%d", i, path, ports.Start, ports.End)
+		}
+	}
+	return list.Policies, nil
+}
+
+// reconcilePolicies creates the rules the policies call for and deletes the
+// policy-sync rules no policy calls for anymore. Each policy allows ingress
+// to the destination's security group from members of the source's.
+func reconcilePolicies(client *neutronClient, n *NetConf, policies []policy, dryRun bool, out io.Writer) error {
+	groups := &policyGroups{client: client, n: n, dryRun: dryRun, out: out, ids: map[string]string{}, names: map[string]string{}}
+
+	var desired []securityGroupRule
+	wanted := map[securityGroupRule]bool{}
+	for _, p := range policies {
+		dst, err := groups.id(p.Destination.ID)
+		if err != nil {
+			return err
+		}
+		src, err := groups.id(p.Source.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, etherType := range []string{"IPv4", "IPv6"} {
+			rule := securityGroupRule{
+				SecurityGroupID: dst,
+				Direction:       "ingress",
+				EtherType:       etherType,
+				Protocol:        p.Destination.Protocol,
+				PortRangeMin:    p.Destination.Ports.Start,
+				PortRangeMax:    p.Destination.Ports.End,
+				RemoteGroupID:   src,
+				Description:     policySyncDescription,
+			}
+			if !wanted[rule] {
+				wanted[rule] = true
+				desired = append(desired, rule)
+			}
+		}
+	}
+
+	actual, err := policySyncRules(client, n)
+	if err != nil {
+		return err
+	}
+
+	existing := map[securityGroupRule]bool{}
+	var stale []securityGroupRule
+	for _, rule := range actual {
+		key := rule
+		key.ID = ""
+		if wanted[key] {
+			existing[key] = true
+		} else {
+			stale = append(stale, rule)
+		}
+	}
+
+	// add new rules before removing old ones so allowed traffic is not
+	// interrupted when a policy only changes its ports
+	for _, rule := range desired {
+		if existing[rule] {
+			continue
+		}
+		fmt.Fprintf(out, "+ %s\n", groups.describe(rule))
+		if dryRun {
+			continue
+		}
+		if err := client.CreateSecurityGroupRule(rule); err != nil {
+			return fmt.Errorf("error calling neutron create security group rule: %w", err)
+		}
+	}
+
+	for _, rule := range stale {
+		fmt.Fprintf(out, "- %s\n", groups.describe(rule))
+		if dryRun {
+			continue
+		}
+		if err := client.DeleteSecurityGroupRule(rule.ID); err != nil && !isNotFound(err) {
+			return fmt.Errorf("error calling neutron delete security group rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// policySyncRules lists the policy-sync rules of the security groups tagged
+// with this cluster, leaving those of other clusters sharing the project to
+// their own policy-sync.
+func policySyncRules(client *neutronClient, n *NetConf) ([]securityGroupRule, error) {
+	groups, err := client.SecurityGroups(ownerTags(n))
+	if err != nil {
+		return nil, fmt.Errorf("error listing security groups: %w", err)
+	}
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	q := url.Values{}
+	q.Set("description", policySyncDescription)
+	for _, g := range groups {
+		q.Add("security_group_id", g.ID)
+	}
+	rules, err := client.SecurityGroupRules(q)
+	if err != nil {
+		return nil, fmt.Errorf("error listing security group rules: %w", err)
+	}
+	return rules, nil
+}
+
+// policyGroups resolves policy groups to the ids of their security groups,
+// creating missing groups unless this is a dry run.
+type policyGroups struct {
+	client *neutronClient
+	n      *NetConf
+	dryRun bool
+	out    io.Writer
+
+	ids   map[string]string
+	names map[string]string
+}
+
+func (g *policyGroups) id(name string) (string, error) {
+	if id, ok := g.ids[name]; ok {
+		return id, nil
+	}
+
+	var id string
+	if g.dryRun {
+		groups, err := g.client.SecurityGroupsByName(name, ownerTags(g.n))
+		if err != nil {
+			return "", err
+		}
+		if len(groups) == 0 {
+			fmt.Fprintf(g.out, "+ security group %s\n", name)
+		} else {
+			id = pickSecurityGroup(groups).ID
+		}
+	} else {
+		// groups outlive a sync, so there is nothing to roll back
+		group, err := ensureSecurityGroup(g.client, g.n, name, &rollback{})
+		if err != nil {
+			return "", err
+		}
+		id = group.ID
+	}
+
+	if id == "" {
+		id = "new-" + name
+	}
+	g.ids[name] = id
+	g.names[id] = name
+	return id, nil
+}
+
+// describe formats a rule with policy group names where they are known.
+func (g *policyGroups) describe(rule securityGroupRule) string {
+	name := func(id string) string {
+		if name, ok := g.names[id]; ok {
+			return name
+		}
+		return id
+	}
+
+	ports := fmt.Sprintf("%d", rule.PortRangeMin)
+	if rule.PortRangeMax != rule.PortRangeMin {
+		ports = fmt.Sprintf("%d-%d", rule.PortRangeMin, rule.PortRangeMax)
+	}
+	return fmt.Sprintf("%s %s %s from %s to %s",
+		rule.EtherType, rule.Protocol, ports, name(rule.RemoteGroupID), name(rule.SecurityGroupID))
+}
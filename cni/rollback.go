@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rollback records how to undo each resource created during ADD so that a
+// failure in a later step leaves nothing behind.
+type rollback struct {
+	steps []rollbackStep
+}
+
+type rollbackStep struct {
+	desc string
+	undo func() error
+}
+
+func (r *rollback) add(desc string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{desc: desc, undo: undo})
+}
+
+// adopt takes over the steps recorded by another rollback.
+func (r *rollback) adopt(other *rollback) {
+	r.steps = append(r.steps, other.steps...)
+	other.steps = nil
+}
+
+// run undoes the recorded steps in reverse order. Failures to undo a step do
+// not stop the rollback and are reported alongside the original error, if any.
+func (r *rollback) run(err error) error {
+	var failures []string
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if undoErr := step.undo(); undoErr != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", step.desc, undoErr))
+		}
+	}
+	r.steps = nil
+
+	if len(failures) == 0 {
+		return err
+	}
+	if err == nil {
+		return fmt.Errorf("rollback failed: %s", strings.Join(failures, "; "))
+	}
+	return fmt.Errorf("%w (rollback failed: %s)", err, strings.Join(failures, "; "))
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+func routerName(n *NetConf) string {
+	name, err := getMetadata("org_id", n.Metadata)
+	if err != nil {
+		// staging containers have no org, like they have no space
+		return "defaultRouter"
+	}
+	return name
+}
+
+// attachSubnets connects the subnets of a new space network to the router of
+// its org, creating the router (with the configured external gateway) for
+// the first space in the org. Attached interfaces are recorded in rb.
+func attachSubnets(client *neutronClient, n *NetConf, subnetIDs []string, rb *rollback) error {
+	name := routerName(n)
+
+	lock, err := lockFile(lockPath(n.StateDir, "router", name))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	router, err := ensureRouter(client, n, name, rb)
+	if err != nil {
+		return err
+	}
+
+	for _, subnetID := range subnetIDs {
+		if err := client.AddRouterInterface(router.ID, subnetID); err != nil {
+			return fmt.Errorf("error attaching subnet %s to router %s: %w", subnetID, router.ID, err)
+		}
+		routerID, subnetID := router.ID, subnetID
+		rb.add("detach subnet "+subnetID, func() error {
+			return detachSubnet(client, routerID, subnetID)
+		})
+	}
+	return nil
+}
+
+func ensureRouter(client *neutronClient, n *NetConf, name string, rb *rollback) (neutronRouter, error) {
+	routers, err := client.RoutersByName(name, ownerTags(n))
+	if err == nil && len(routers) == 0 {
+		routers, err = adoptRouters(client, n, name)
+	}
+	if err != nil {
+		return neutronRouter{}, err
+	}
+	if len(routers) > 0 {
+		return pickRouter(routers), nil
+	}
+
+	router := neutronRouter{
+		Name:         name,
+		AdminStateUp: true,
+		Tags:         resourceTags(n, "org_id"),
+	}
+	if n.ExternalNetworkID != "" {
+		router.ExternalGatewayInfo = &externalGatewayInfo{NetworkID: n.ExternalNetworkID}
+	}
+
+	created, err := client.CreateRouter(router)
+	if err != nil {
+		return neutronRouter{}, fmt.Errorf("error calling neutron create router: %w", err)
+	}
+	rb.add("delete router "+created.ID, func() error {
+		return deleteRouterIfUnused(client, created.ID)
+	})
+
+	routers, err = client.RoutersByName(name, ownerTags(n))
+	if err != nil {
+		return neutronRouter{}, err
+	}
+	winner := pickRouter(append(routers, created))
+	if winner.ID != created.ID {
+		if err := deleteRouterIfUnused(client, created.ID); err != nil {
+			return neutronRouter{}, err
+		}
+	}
+	return winner, nil
+}
+
+// adoptRouters tags and returns the untagged routers of an org.
+func adoptRouters(client *neutronClient, n *NetConf, name string) ([]neutronRouter, error) {
+	routers, err := client.RoutersByName(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	var adopted []neutronRouter
+	for _, router := range routers {
+		ok, err := adoptUntagged(client, "routers", router.ID, router.Tags, resourceTags(n, "org_id"))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			adopted = append(adopted, router)
+		}
+	}
+	return adopted, nil
+}
+
+func pickRouter(routers []neutronRouter) neutronRouter {
+	return routers[pickOldest(len(routers), func(i int) (string, string) {
+		return routers[i].CreatedAt, routers[i].ID
+	})]
+}
+
+// detachRouterInterfaces removes the router interfaces of a network that is
+// about to be deleted, under the lock of the org router.
+func detachRouterInterfaces(client *neutronClient, n *NetConf, interfaces []routerInterface) error {
+	lock, err := lockFile(lockPath(n.StateDir, "router", routerName(n)))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	for _, iface := range interfaces {
+		for _, fixedIP := range iface.FixedIPs {
+			if err := detachSubnet(client, iface.DeviceID, fixedIP.SubnetID); err != nil {
+				return fmt.Errorf("error detaching subnet %s from router %s: %w", fixedIP.SubnetID, iface.DeviceID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// detachSubnet removes a subnet's interface from a router, deleting the
+// router once its last subnet is gone.
+func detachSubnet(client *neutronClient, routerID, subnetID string) error {
+	err := client.RemoveRouterInterface(routerID, subnetID)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return deleteRouterIfUnused(client, routerID)
+}
+
+func deleteRouterIfUnused(client *neutronClient, routerID string) error {
+	q := url.Values{}
+	q.Set("device_id", routerID)
+
+	interfaces, err := client.RouterInterfaces(q)
+	if err != nil {
+		return err
+	}
+	if len(interfaces) > 0 {
+		return nil
+	}
+
+	// a conflict means another host attached a subnet in the meantime
+	err = client.DeleteRouter(routerID)
+	if err != nil && !isNotFound(err) && !isConflict(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import "fmt"
+
+// portSecurity returns the security groups and port security setting for a
+// new container port. Containers of a Cloud Foundry policy group share a
+// security group that allows traffic between its members; containers
+// without one get Neutron's default security group.
+//
+// Policy group ports deliberately get only their group's security group, not
+// the project default one as well: the default group admits traffic from
+// every other port in the project, which would bypass the policies that
+// policy-sync turns into rules. Egress stays open through the rules Neutron
+// adds to every new group.
+func portSecurity(client *neutronClient, n *NetConf, rb *rollback) ([]string, *bool, error) {
+	if n.DisablePortSecurity {
+		disabled := false
+		return nil, &disabled, nil
+	}
+
+	name, err := getMetadata("policy_group_id", n.Metadata)
+	if err != nil || name == "" {
+		return nil, nil, nil
+	}
+
+	group, err := ensureSecurityGroup(client, n, name, rb)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []string{group.ID}, nil, nil
+}
+
+func ensureSecurityGroup(client *neutronClient, n *NetConf, name string, rb *rollback) (securityGroup, error) {
+	lock, err := lockFile(lockPath(n.StateDir, "security-group", name))
+	if err != nil {
+		return securityGroup{}, err
+	}
+	defer lock.Unlock()
+
+	groups, err := client.SecurityGroupsByName(name, ownerTags(n))
+	if err == nil && len(groups) == 0 {
+		groups, err = adoptSecurityGroups(client, n, name)
+	}
+	if err != nil {
+		return securityGroup{}, err
+	}
+	if len(groups) > 0 {
+		return pickSecurityGroup(groups), nil
+	}
+
+	created, err := createSecurityGroup(client, n, name, rb)
+	if err != nil {
+		return securityGroup{}, err
+	}
+
+	groups, err = client.SecurityGroupsByName(name, ownerTags(n))
+	if err != nil {
+		return securityGroup{}, err
+	}
+	winner := pickSecurityGroup(append(groups, created))
+	if winner.ID != created.ID {
+		if err := deleteSecurityGroupIfUnused(client, created.ID); err != nil {
+			return securityGroup{}, err
+		}
+	}
+	return winner, nil
+}
+
+// createSecurityGroup creates a policy group's security group. Neutron adds
+// rules allowing all egress; ingress is allowed from members of the group.
+func createSecurityGroup(client *neutronClient, n *NetConf, name string, rb *rollback) (securityGroup, error) {
+	group, err := client.CreateSecurityGroup(securityGroup{
+		Name:        name,
+		Description: "Cloud Foundry policy group " + name,
+		Tags:        ownerTags(n),
+	})
+	if err != nil {
+		return securityGroup{}, fmt.Errorf("error calling neutron create security group: %w", err)
+	}
+	rb.add("delete security group "+group.ID, func() error {
+		return deleteSecurityGroupIfUnused(client, group.ID)
+	})
+
+	for _, etherType := range []string{"IPv4", "IPv6"} {
+		err := client.CreateSecurityGroupRule(securityGroupRule{
+			SecurityGroupID: group.ID,
+			Direction:       "ingress",
+			EtherType:       etherType,
+			RemoteGroupID:   group.ID,
+		})
+		if err != nil {
+			return securityGroup{}, fmt.Errorf("error calling neutron create security group rule: %w", err)
+		}
+	}
+	return group, nil
+}
+
+// adoptSecurityGroups tags and returns the untagged security groups of a
+// policy group.
+func adoptSecurityGroups(client *neutronClient, n *NetConf, name string) ([]securityGroup, error) {
+	groups, err := client.SecurityGroupsByName(name, nil)
+	if err != nil {
+		return nil, err
+	}
+	var adopted []securityGroup
+	for _, group := range groups {
+		ok, err := adoptUntagged(client, "security-groups", group.ID, group.Tags, ownerTags(n))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			adopted = append(adopted, group)
+		}
+	}
+	return adopted, nil
+}
+
+func pickSecurityGroup(groups []securityGroup) securityGroup {
+	return groups[pickOldest(len(groups), func(i int) (string, string) {
+		return groups[i].CreatedAt, groups[i].ID
+	})]
+}
+
+func deleteSecurityGroupIfUnused(client *neutronClient, id string) error {
+	// a conflict means ports of another container already use the group
+	err := client.DeleteSecurityGroup(id)
+	if err != nil && !isNotFound(err) && !isConflict(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"path/filepath"
+)
+
+// Host-wide lock held while picking a CIDR out of the supernet, so that
+// spaces created concurrently on this host get distinct subnets.
+const supernetLockFile = ".supernet.lock"
+
+const defaultSubnetPrefixLen = 24
+
+// SLAAC only works on /64s, so IPv6 subnets are always this size
+const ipv6SubnetPrefixLen = 64
+
+// IPv6 address modes selectable with 'ipv6_mode'
+const (
+	ipv6ModeSLAAC          = "slaac"
+	ipv6ModeDHCPv6Stateful = "dhcpv6-stateful"
+)
+
+// newSubnet builds the subnet for a new space network. It is allocated from a
+// Neutron subnet pool, carved out of the configured supernet or, when neither
+// is configured, uses the default CIDR.
+func newSubnet(client *neutronClient, n *NetConf, networkID string) (neutronSubnet, error) {
+	subnet := neutronSubnet{
+		NetworkID: networkID,
+		IPVersion: 4,
+		Tags:      networkTags(n),
+	}
+
+	switch {
+	case n.SubnetPoolID != "":
+		subnet.SubnetPoolID = n.SubnetPoolID
+		subnet.PrefixLen = n.SubnetPrefixLen
+	case n.Supernet != "":
+		cidr, err := freeCIDR(client, 4, n.Supernet, n.SubnetPrefixLen)
+		if err != nil {
+			return subnet, err
+		}
+		subnet.CIDR = cidr
+	default:
+		subnet.CIDR = defaultCIDR
+		subnet.AllocationPools = []allocationPool{
+			{
+				Start: defaultNetStart,
+				End:   defaultNetEnd,
+			},
+		}
+	}
+	return subnet, nil
+}
+
+// newSubnet6 builds the IPv6 subnet created next to the IPv4 one when
+// 'ipv6_mode' is set, from a Neutron subnet pool or carved out of the
+// configured IPv6 supernet.
+func newSubnet6(client *neutronClient, n *NetConf, networkID string) (neutronSubnet, error) {
+	subnet := neutronSubnet{
+		NetworkID:       networkID,
+		IPVersion:       6,
+		IPv6RAMode:      n.IPv6Mode,
+		IPv6AddressMode: n.IPv6Mode,
+		Tags:            networkTags(n),
+	}
+
+	if n.IPv6SubnetPoolID != "" {
+		subnet.SubnetPoolID = n.IPv6SubnetPoolID
+		subnet.PrefixLen = ipv6SubnetPrefixLen
+		return subnet, nil
+	}
+
+	cidr, err := freeCIDR(client, 6, n.IPv6Supernet, ipv6SubnetPrefixLen)
+	if err != nil {
+		return subnet, err
+	}
+	subnet.CIDR = cidr
+	return subnet, nil
+}
+
+// maxSubnetAttempts bounds how often createSubnet picks another CIDR after
+// losing it to another host.
+const maxSubnetAttempts = 5
+
+// createSubnet creates the subnet newSubnet builds, recording it in rb. The
+// supernet lock only keeps hosts from picking the same CIDR of a supernet
+// one at a time, so after creating a subnet carved out of a supernet it
+// lists the subnets again. If another host created an overlapping subnet
+// first, it deletes its own and picks another CIDR.
+func createSubnet(client *neutronClient, newSubnet func() (neutronSubnet, error), carved bool, rb *rollback) (neutronSubnet, error) {
+	for attempt := 0; attempt < maxSubnetAttempts; attempt++ {
+		subnet, err := newSubnet()
+		if err != nil {
+			return neutronSubnet{}, err
+		}
+
+		s, err := client.CreateSubnet(subnet)
+		if err != nil {
+			return neutronSubnet{}, fmt.Errorf("error calling neutron create subnet: %w", err)
+		}
+		created := &rollback{}
+		created.add("delete subnet "+s.ID, func() error {
+			return client.DeleteSubnet(s.ID)
+		})
+
+		if !carved {
+			rb.adopt(created)
+			return s, nil
+		}
+
+		lost, err := overlapsOlderSubnet(client, s)
+		if err != nil {
+			return neutronSubnet{}, created.run(err)
+		}
+		if !lost {
+			rb.adopt(created)
+			return s, nil
+		}
+		if err := created.run(nil); err != nil {
+			return neutronSubnet{}, err
+		}
+	}
+	return neutronSubnet{}, fmt.Errorf("failed to allocate a subnet not overlapping those of other hosts after %d attempts", maxSubnetAttempts)
+}
+
+// overlapsOlderSubnet reports whether a subnet overlaps one created before
+// it, which keeps its CIDR.
+func overlapsOlderSubnet(client *neutronClient, s neutronSubnet) (bool, error) {
+	_, ipn, err := net.ParseCIDR(s.CIDR)
+	if err != nil {
+		return false, fmt.Errorf("invalid CIDR %q of neutron subnet %s: %w", s.CIDR, s.ID, err)
+	}
+
+	subnets, err := client.Subnets(s.IPVersion)
+	if err != nil {
+		return false, fmt.Errorf("error listing neutron subnets: %w", err)
+	}
+
+	overlapping := []neutronSubnet{s}
+	for _, other := range subnets {
+		_, otherNet, err := net.ParseCIDR(other.CIDR)
+		if err != nil || other.ID == s.ID || !overlaps(ipn, otherNet) {
+			continue
+		}
+		overlapping = append(overlapping, other)
+	}
+
+	winner := pickOldest(len(overlapping), func(i int) (string, string) {
+		return overlapping[i].CreatedAt, overlapping[i].ID
+	})
+	return overlapping[winner].ID != s.ID, nil
+}
+
+// freeCIDR picks the first prefix of the given length in the supernet that
+// does not overlap any existing subnet.
+func freeCIDR(client *neutronClient, ipVersion int, supernet string, prefixLen int) (string, error) {
+	_, super, err := net.ParseCIDR(supernet)
+	if err != nil {
+		return "", fmt.Errorf("invalid supernet %q: %w", supernet, err)
+	}
+
+	subnets, err := client.Subnets(ipVersion)
+	if err != nil {
+		return "", fmt.Errorf("error listing neutron subnets: %w", err)
+	}
+
+	var used []*net.IPNet
+	for _, s := range subnets {
+		if _, ipn, err := net.ParseCIDR(s.CIDR); err == nil {
+			used = append(used, ipn)
+		}
+	}
+
+	cidr, ok := nextFreeCIDR(super, prefixLen, used)
+	if !ok {
+		return "", fmt.Errorf("supernet %s has no free /%d subnets left", supernet, prefixLen)
+	}
+	return cidr.String(), nil
+}
+
+// nextFreeCIDR returns the first prefix of the given length in the supernet
+// that overlaps none of the used subnets. Rather than trying every prefix,
+// which never ends in a large IPv6 supernet, it skips past the used subnet
+// each candidate overlaps, so it tries at most one candidate per used subnet
+// plus one.
+func nextFreeCIDR(super *net.IPNet, prefixLen int, used []*net.IPNet) (*net.IPNet, bool) {
+	superLen, bits := super.Mask.Size()
+	if prefixLen < superLen || prefixLen > bits {
+		return nil, false
+	}
+
+	step := new(big.Int).Lsh(big.NewInt(1), uint(bits-prefixLen))
+	start := new(big.Int).SetBytes(super.IP)
+	end := new(big.Int).Add(start, new(big.Int).Lsh(big.NewInt(1), uint(bits-superLen)))
+
+	for new(big.Int).Add(start, step).Cmp(end) <= 0 {
+		candidate := &net.IPNet{
+			IP:   bigToIP(start, len(super.IP)),
+			Mask: net.CIDRMask(prefixLen, bits),
+		}
+
+		var overlapped *net.IPNet
+		for _, u := range used {
+			if overlaps(candidate, u) {
+				overlapped = u
+				break
+			}
+		}
+		if overlapped == nil {
+			return candidate, true
+		}
+
+		// continue after the candidate, or after the used subnet if it
+		// ends later, rounded up to the next prefix
+		next := new(big.Int).Add(start, step)
+		if usedEnd := subnetEnd(overlapped); usedEnd.Cmp(next) > 0 {
+			next = usedEnd.Add(usedEnd, step)
+			next.Sub(next, big.NewInt(1))
+			next.Div(next, step)
+			next.Mul(next, step)
+		}
+		start = next
+	}
+	return nil, false
+}
+
+// subnetEnd returns the address just past the end of a subnet.
+func subnetEnd(ipn *net.IPNet) *big.Int {
+	ones, bits := ipn.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	return size.Add(size, new(big.Int).SetBytes(ipn.IP.Mask(ipn.Mask)))
+}
+
+func bigToIP(i *big.Int, size int) net.IP {
+	b := i.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// delegateSubnet describes the subnet of a container address to the
+// delegate plugin, so it can set up the prefix route, the default route via
+// the gateway and any host routes.
+type delegateSubnet struct {
+	CIDR           string          `json:"cidr"`
+	Gateway        string          `json:"gateway,omitempty"`
+	Routes         []delegateRoute `json:"routes,omitempty"`
+	DNSNameservers []string        `json:"dns_nameservers,omitempty"`
+}
+
+type delegateRoute struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+func lookupDelegateSubnet(client *neutronClient, subnetID string) (delegateSubnet, error) {
+	subnet, err := client.Subnet(subnetID)
+	if err != nil {
+		return delegateSubnet{}, fmt.Errorf("error looking up neutron subnet %s: %w", subnetID, err)
+	}
+
+	ds := delegateSubnet{
+		CIDR:           subnet.CIDR,
+		Gateway:        subnet.GatewayIP,
+		DNSNameservers: subnet.DNSNameservers,
+	}
+	for _, r := range subnet.HostRoutes {
+		ds.Routes = append(ds.Routes, delegateRoute{
+			Dst: r.Destination,
+			GW:  r.NextHop,
+		})
+	}
+	return ds, nil
+}
+
+func validateSubnetConfig(n *NetConf) error {
+	if n.SubnetPrefixLen == 0 {
+		n.SubnetPrefixLen = defaultSubnetPrefixLen
+	}
+
+	if n.Supernet != "" && n.SubnetPoolID != "" {
+		return errors.New("only one of 'supernet' and 'subnetpool_id' may be set in CNI net config")
+	}
+
+	if n.Supernet != "" {
+		_, super, err := net.ParseCIDR(n.Supernet)
+		if err != nil || super.IP.To4() == nil {
+			return fmt.Errorf("invalid IPv4 'supernet' %q in CNI net config", n.Supernet)
+		}
+		superLen, _ := super.Mask.Size()
+		if n.SubnetPrefixLen < superLen || n.SubnetPrefixLen > 30 {
+			return fmt.Errorf("invalid 'subnet_prefix_len' %d for supernet %s in CNI net config", n.SubnetPrefixLen, n.Supernet)
+		}
+	}
+	return validateIPv6Config(n)
+}
+
+func validateIPv6Config(n *NetConf) error {
+	switch n.IPv6Mode {
+	case "":
+		return nil
+	case ipv6ModeSLAAC, ipv6ModeDHCPv6Stateful:
+	default:
+		return fmt.Errorf("invalid 'ipv6_mode' %q in CNI net config", n.IPv6Mode)
+	}
+
+	if (n.IPv6Supernet == "") == (n.IPv6SubnetPoolID == "") {
+		return errors.New("exactly one of 'ipv6_supernet' and 'ipv6_subnetpool_id' must be set with 'ipv6_mode' in CNI net config")
+	}
+
+	if n.IPv6Supernet != "" {
+		_, super, err := net.ParseCIDR(n.IPv6Supernet)
+		if err != nil || super.IP.To4() != nil {
+			return fmt.Errorf("invalid IPv6 'ipv6_supernet' %q in CNI net config", n.IPv6Supernet)
+		}
+		if superLen, _ := super.Mask.Size(); superLen > ipv6SubnetPrefixLen {
+			return fmt.Errorf("'ipv6_supernet' %s must be at least a /%d in CNI net config", n.IPv6Supernet, ipv6SubnetPrefixLen)
+		}
+	}
+	return nil
+}
+
+func supernetLockPath(stateDir string) string {
+	return filepath.Join(stateDir, supernetLockFile)
+}
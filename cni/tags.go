@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// managedTag marks the Neutron resources gofer creates, so that lookups by
+// name never pick up networks, routers or security groups of anyone else.
+const managedTag = "gofer"
+
+// Container ports are owned by deviceOwner, or by agentDeviceOwner when the
+// Neutron OVS agent binds them. Neutron sends Nova an event for each status
+// change of a port with a compute: owner, which Nova rejects for devices that
+// are not its instances, so only bound ports get the compute: prefix, which
+// distributed routers need to route the port.
+const (
+	deviceOwner      = "gofer:container"
+	agentDeviceOwner = "compute:gofer"
+)
+
+// deviceOwners are the owners of container ports of either kind. Ports
+// created before container ports had their own owner have agentDeviceOwner.
+var deviceOwners = []string{deviceOwner, agentDeviceOwner}
+
+// isContainerPort reports whether a port is a container port or an instance
+// port, i.e. one that keeps its network in use.
+func isContainerPort(owner string) bool {
+	return owner == deviceOwner || strings.HasPrefix(owner, "compute:")
+}
+
+// metadataKeys are the Cloud Foundry metadata copied into port tags
+var metadataKeys = []string{"app_id", "org_id", "space_id", "policy_group_id"}
+
+// ownerTags are the tags shared by all resources of this gofer cluster.
+func ownerTags(n *NetConf) []string {
+	tags := []string{managedTag}
+	if n.ClusterID != "" {
+		tags = append(tags, "cluster_id:"+n.ClusterID)
+	}
+	return tags
+}
+
+// resourceTags are the owner tags plus a "key:value" tag for each of the
+// given metadata keys set for the container.
+func resourceTags(n *NetConf, keys ...string) []string {
+	tags := ownerTags(n)
+	for _, key := range keys {
+		if value, err := getMetadata(key, n.Metadata); err == nil && value != "" {
+			tags = append(tags, key+":"+value)
+		}
+	}
+	return tags
+}
+
+// hostTag marks the ports of containers on this host.
+func hostTag(n *NetConf) string {
+	return "host:" + n.HostID
+}
+
+// withTags adds a filter matching resources that have all of tags, if any.
+func withTags(q url.Values, tags []string) url.Values {
+	if len(tags) > 0 {
+		q.Set("tags", strings.Join(tags, ","))
+	}
+	return q
+}
+
+// adoptUntagged tags a network, router or security group found by name that
+// has no tags at all, as releases before tagging created it, so that lookups
+// by tag find it from now on. Resources with tags belong to someone else and
+// are left alone. It reports whether the resource was adopted.
+func adoptUntagged(client *neutronClient, collection, id string, existing, tags []string) (bool, error) {
+	if len(existing) > 0 {
+		return false, nil
+	}
+	if err := client.ReplaceTags(collection, id, tags); err != nil {
+		return false, fmt.Errorf("error tagging %s %s: %w", collection, id, err)
+	}
+	return true, nil
+}
+
+func validateClusterID(n *NetConf) error {
+	// tag filters are comma separated
+	if strings.Contains(n.ClusterID, ",") {
+		return errors.New("invalid 'cluster_id' in CNI net config, must not contain ','")
+	}
+	return nil
+}
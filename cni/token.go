@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Keystone tokens are cached in the state dir so that a cell starting many
+// containers does not authenticate once per CNI invocation. The cache and its
+// lock are dotfiles so they are never mistaken for container state.
+const tokenCacheFile = ".keystone-token"
+const tokenLockFile = ".keystone-token.lock"
+
+// Keystone's default token expiration, used when the expiry is unknown.
+const defaultTokenLifetime = time.Hour
+
+// A cached token is refreshed this long before it actually expires.
+const tokenExpiryMargin = 5 * time.Minute
+
+type cachedToken struct {
+	Key       string    `json:"key"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type tokenCache struct {
+	dir   string
+	key   string
+	fetch func() (string, time.Time, error)
+}
+
+func newTokenCache(n *NetConf) *tokenCache {
+	return &tokenCache{
+		dir:   n.StateDir,
+		key:   tokenCacheKey(n),
+		fetch: func() (string, time.Time, error) { return requestToken(n) },
+	}
+}
+
+// tokenCacheKey identifies the credentials a token was issued for, so a
+// config change never reuses a token obtained with different credentials.
+func tokenCacheKey(n *NetConf) string {
+	h := sha256.New()
+	for _, s := range []string{
+		n.KeystoneURL,
+		n.KeystoneUsername,
+		n.KeystoneUserDomain,
+		n.KeystoneProject,
+		n.KeystoneProjectID,
+		n.KeystoneProjectDomain,
+		n.KeystoneAuthType,
+		n.KeystoneApplicationCredentialID,
+		n.KeystoneTrustID,
+	} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Token returns a cached token if it is still valid, otherwise it fetches a
+// new one from Keystone. The lock is held while fetching so that concurrent
+// plugin processes wait for a single token rather than each requesting one.
+func (c *tokenCache) Token() (string, error) {
+	lock, err := lockFile(filepath.Join(c.dir, tokenLockFile))
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	if t, ok := c.load(); ok && time.Now().Add(tokenExpiryMargin).Before(t.ExpiresAt) {
+		return t.Token, nil
+	}
+
+	token, expiresAt, err := c.fetch()
+	if err != nil {
+		return "", err
+	}
+
+	err = c.save(cachedToken{
+		Key:       c.key,
+		Token:     token,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Invalidate drops the cached token if it is still the given stale token.
+// A token refreshed in the meantime by another process is left alone.
+func (c *tokenCache) Invalidate(stale string) error {
+	lock, err := lockFile(filepath.Join(c.dir, tokenLockFile))
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	if t, ok := c.load(); ok && t.Token != stale {
+		return nil
+	}
+
+	err = os.Remove(filepath.Join(c.dir, tokenCacheFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *tokenCache) load() (cachedToken, bool) {
+	var t cachedToken
+	bytes, err := ioutil.ReadFile(filepath.Join(c.dir, tokenCacheFile))
+	if err != nil {
+		return t, false
+	}
+	if err := json.Unmarshal(bytes, &t); err != nil {
+		return t, false
+	}
+	return t, t.Key == c.key && t.Token != ""
+}
+
+func (c *tokenCache) save(t cachedToken) error {
+	bytes, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	// write to a temp file and rename so readers never see a partial token
+	tmp, err := ioutil.TempFile(c.dir, tokenCacheFile)
+	if err != nil {
+		return fmt.Errorf("failed to cache keystone token: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(bytes)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to cache keystone token: %w", err)
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, tokenCacheFile))
+}
+
+// withNeutron calls fn with a Neutron client authenticated by a cached token,
+// which the client replaces if Neutron rejects it.
+func withNeutron(n *NetConf, fn func(*neutronClient) error) error {
+	tokens := newTokenCache(n)
+
+	token, err := tokens.Token()
+	if err != nil {
+		return err
+	}
+
+	client, err := newNeutronClient(n.NeutronURL, token)
+	if err != nil {
+		return err
+	}
+	client.tokens = tokens
+	return fn(client)
+}